@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"reflect"
+	"time"
+)
+
+// Alarm is a state change of a monitored condition, published on
+// tele/<topic>/ALARM
+type Alarm struct {
+	Source  string // es. thermostat
+	Name    string // zone or sensor name
+	Kind    string // es. feedback_failure
+	Active  bool
+	Message string
+	// sensor value, when the alarm has one
+	Value *float64
+}
+
+// RaiseAlarm publishes the alarm on MQTT and sends its message to the
+// allowed phones
+func RaiseAlarm(alarm Alarm) {
+
+	if alarm.Active {
+		log.Printf("alarm: %s", alarm.Message)
+	} else {
+		log.Printf("alarm cleared: %s", alarm.Message)
+	}
+
+	client := getMQTTClient()
+	if client != nil {
+		jsonObj := map[string]interface{}{
+			"Time":    time.Now().UTC().Format(MQTT_DATETIME_FORMAT),
+			"Source":  alarm.Source,
+			"Name":    alarm.Name,
+			"Kind":    alarm.Kind,
+			"Active":  alarm.Active,
+			"Message": alarm.Message,
+		}
+		if alarm.Value != nil {
+			jsonObj["Value"] = float64(int(*alarm.Value*100)) / 100.0
+		}
+		jsonStr, err := json.Marshal(jsonObj)
+		if err != nil {
+			log.Println(err)
+		} else {
+			client.Publish(fmt.Sprintf("tele/%s/ALARM", getConfig().MQTT.Topic), 0, false, jsonStr)
+		}
+	}
+
+	if alarm.Active {
+		NotifyPhones("ALLARME: " + alarm.Message)
+	} else {
+		NotifyPhones("RIENTRATO: " + alarm.Message)
+	}
+}
+
+// SensorAlarmConfig are the alarm thresholds of a sensor, each one is
+// disabled when unset or zero. Rate is in °C per minute, either way,
+// Offline in seconds without a good read. A high or low alarm clears
+// once the temperature is back by Hysteresis, an active alarm is sent
+// again every Renotify seconds.
+type SensorAlarmConfig struct {
+	High       *float64 `json:"high"`
+	Low        *float64 `json:"low"`
+	Rate       float64  `json:"rate"`
+	Offline    uint     `json:"offline"`
+	Hysteresis float64  `json:"hysteresis"`
+	Renotify   uint     `json:"renotify"`
+}
+
+func (a SensorAlarmConfig) enabled() bool {
+	return a.High != nil || a.Low != nil || a.Rate > 0 || a.Offline > 0
+}
+
+// alarm state of a sensor, by sensor name
+type sensorAlarmState struct {
+	cfg       SensorAlarmConfig
+	sampledAt time.Time
+	// last good read, okValue is unknown until the first one
+	okAt    time.Time
+	okValue *float64
+	// active alarms by kind, with the last notification
+	active map[string]time.Time
+}
+
+// SensorAlarmRoutine checks the sensor samples against their alarm
+// thresholds every second
+func SensorAlarmRoutine() {
+	states := map[string]*sensorAlarmState{}
+
+	for {
+		now := time.Now().UTC()
+		samples := map[string]SensorSample{}
+		for _, s := range LatestSamples() {
+			samples[s.Name] = s
+		}
+
+		names := map[string]bool{}
+		for _, s := range getConfig().Onewires {
+			if !s.Alarms.enabled() {
+				continue
+			}
+			names[s.Name] = true
+
+			st, ok := states[s.Name]
+			if !ok || !reflect.DeepEqual(st.cfg, s.Alarms) {
+				// Offline counts from startup or from the config change
+				st = &sensorAlarmState{cfg: s.Alarms, okAt: now, active: map[string]time.Time{}}
+				states[s.Name] = st
+			}
+			checkSensorAlarms(s, st, samples[s.Name], now)
+		}
+		for name := range states {
+			if !names[name] {
+				delete(states, name)
+			}
+		}
+
+		time.Sleep(time.Second)
+	}
+}
+
+func checkSensorAlarms(s OneWireSensor, st *sensorAlarmState, sample SensorSample, now time.Time) {
+	a := s.Alarms
+	value := sample.fValue
+
+	if sample.SampledAt.After(st.sampledAt) {
+		st.sampledAt = sample.SampledAt
+		if sample.Status == "ok" {
+			if a.Rate > 0 && st.okValue != nil && sample.SampledAt.Sub(st.okAt) > 0 {
+				rate := (value - *st.okValue) / sample.SampledAt.Sub(st.okAt).Minutes()
+				setSensorAlarm(s, st, "rate", math.Abs(rate) > a.Rate, value, now,
+					fmt.Sprintf("sensor %s: temperature changing by %.2f C/min", s.Name, rate))
+			}
+			st.okAt = sample.SampledAt
+			st.okValue = &value
+
+			if a.High != nil {
+				_, active := st.active["high"]
+				active = value > *a.High || (active && value > *a.High-a.Hysteresis)
+				setSensorAlarm(s, st, "high", active, value, now,
+					fmt.Sprintf("sensor %s: temperature %.1f C above %.1f C", s.Name, value, *a.High))
+			}
+			if a.Low != nil {
+				_, active := st.active["low"]
+				active = value < *a.Low || (active && value < *a.Low+a.Hysteresis)
+				setSensorAlarm(s, st, "low", active, value, now,
+					fmt.Sprintf("sensor %s: temperature %.1f C below %.1f C", s.Name, value, *a.Low))
+			}
+		}
+	}
+
+	if a.Offline > 0 {
+		offline := now.Sub(st.okAt) > time.Duration(a.Offline)*time.Second
+		message := fmt.Sprintf("sensor %s: no reading since %s", s.Name, st.okAt.Local().Format("02/01 15:04"))
+		if !offline {
+			message = fmt.Sprintf("sensor %s: reading again", s.Name)
+		}
+		setSensorAlarm(s, st, "offline", offline, value, now, message)
+	}
+}
+
+// setSensorAlarm raises the alarm when it becomes active, clears it when
+// it's no longer active and renotifies it while it stays active
+func setSensorAlarm(s OneWireSensor, st *sensorAlarmState, kind string, active bool, value float64, now time.Time, message string) {
+	notifiedAt, wasActive := st.active[kind]
+	renotify := time.Duration(s.Alarms.Renotify) * time.Second
+
+	switch {
+	case active && (!wasActive || (renotify > 0 && now.Sub(notifiedAt) >= renotify)):
+		st.active[kind] = now
+	case !active && wasActive:
+		delete(st.active, kind)
+		if kind == "rate" {
+			message = fmt.Sprintf("sensor %s: temperature change back under %.2f C/min", s.Name, s.Alarms.Rate)
+		} else if kind != "offline" {
+			message = fmt.Sprintf("sensor %s: temperature %.1f C back to normal", s.Name, value)
+		}
+	default:
+		return
+	}
+
+	alarm := Alarm{Source: "sensor", Name: s.Name, Kind: kind, Active: active, Message: message}
+	if kind != "offline" {
+		alarm.Value = &value
+	}
+	RaiseAlarm(alarm)
+}
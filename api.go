@@ -0,0 +1,369 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+type HTTPConfig struct {
+	Enabled  bool   `json:"enabled"`
+	Listen   string `json:"listen"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Token    string `json:"token"`
+}
+
+var startedAt = time.Now().UTC()
+
+type apiSensor struct {
+	Name      string    `json:"name"`
+	Type      string    `json:"type"`
+	Status    string    `json:"status"`
+	Value     float64   `json:"value"`
+	SampledAt time.Time `json:"sampled_at"`
+}
+
+type apiOutput struct {
+	Name  string `json:"name"`
+	State bool   `json:"state"`
+}
+
+type apiInput struct {
+	Name  string `json:"name"`
+	Topic string `json:"topic"`
+	State bool   `json:"state"`
+}
+
+type apiThermostat struct {
+	Name       string   `json:"name"`
+	Enabled    bool     `json:"enabled"`
+	Mode       string   `json:"mode"`
+	Modes      []string `json:"modes"`
+	Setpoint   float64  `json:"setpoint"`
+	Min        float64  `json:"min_setpoint"`
+	Max        float64  `json:"max_setpoint"`
+	Step       float64  `json:"setpoint_step"`
+	Hysteresis float64  `json:"hysteresis"`
+	Actuator   string   `json:"actuator"`
+	Cooling    string   `json:"cooling_actuator,omitempty"`
+	Deadband   float64  `json:"deadband,omitempty"`
+	Feedback   string   `json:"feedback"`
+	Regulator  string   `json:"regulator"`
+}
+
+// PUT bodies, missing fields are left untouched
+type apiOutputUpdate struct {
+	State interface{} `json:"state"`
+}
+
+type apiThermostatUpdate struct {
+	Enabled    *bool    `json:"enabled"`
+	Mode       *string  `json:"mode"`
+	Setpoint   *float64 `json:"setpoint"`
+	Hysteresis *float64 `json:"hysteresis"`
+}
+
+func HTTPRoutine(httpConfig HTTPConfig) {
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/health", apiHealth)
+	mux.Handle("/api/sensors", apiAuth(httpConfig, http.HandlerFunc(apiSensors)))
+	mux.Handle("/api/outputs", apiAuth(httpConfig, http.HandlerFunc(apiOutputs)))
+	mux.Handle("/api/outputs/", apiAuth(httpConfig, http.HandlerFunc(apiOutputs)))
+	mux.Handle("/api/inputs", apiAuth(httpConfig, http.HandlerFunc(apiInputs)))
+	mux.Handle("/api/sms", apiAuth(httpConfig, http.HandlerFunc(apiSMS)))
+	mux.Handle("/api/thermostat", apiAuth(httpConfig, http.HandlerFunc(apiThermostatHandler)))
+	mux.Handle("/api/thermostats", apiAuth(httpConfig, http.HandlerFunc(apiThermostatHandler)))
+	mux.Handle("/api/thermostats/", apiAuth(httpConfig, http.HandlerFunc(apiThermostatHandler)))
+	mux.Handle("/metrics", apiAuth(httpConfig, http.HandlerFunc(metricsHandler)))
+
+	listen := httpConfig.Listen
+	if len(listen) == 0 {
+		listen = ":8080"
+	}
+
+	log.Printf("http: listening on %s", listen)
+	err := http.ListenAndServe(listen, mux)
+	if err != nil {
+		log.Printf("http: %v", err)
+	}
+}
+
+// apiAuth accepts either a bearer token or basic auth credentials, when
+// none of them is configured the API is open
+func apiAuth(httpConfig HTTPConfig, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if len(httpConfig.Token) == 0 && len(httpConfig.Username) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if len(httpConfig.Token) > 0 {
+			auth := r.Header.Get("Authorization")
+			if strings.HasPrefix(auth, "Bearer ") && secureCompare(strings.TrimPrefix(auth, "Bearer "), httpConfig.Token) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		if len(httpConfig.Username) > 0 {
+			user, pass, ok := r.BasicAuth()
+			if ok && secureCompare(user, httpConfig.Username) && secureCompare(pass, httpConfig.Password) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="fortino"`)
+		}
+
+		writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+	})
+}
+
+func secureCompare(a string, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Printf("http: %v", err)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+func apiHealth(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":         "ok",
+		"uptime":         int(time.Since(startedAt).Seconds()),
+		"mqtt_connected": mqttConnected(),
+	})
+}
+
+func apiSensors(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	sensors := []apiSensor{}
+	for _, s := range LatestSamples() {
+		sensors = append(sensors, apiSensor{
+			Name:      s.Name,
+			Type:      s.Type,
+			Status:    s.Status,
+			Value:     s.fValue,
+			SampledAt: s.SampledAt,
+		})
+	}
+	sort.Slice(sensors, func(i, j int) bool { return sensors[i].Name < sensors[j].Name })
+
+	writeJSON(w, http.StatusOK, sensors)
+}
+
+func apiOutputs(w http.ResponseWriter, r *http.Request) {
+
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/outputs"), "/")
+
+	if len(name) == 0 {
+		if r.Method != http.MethodGet {
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		outputs := []apiOutput{}
+		for _, name := range outputNames(getConfig()) {
+			state, _ := GetOutputState(name)
+			outputs = append(outputs, apiOutput{Name: name, State: state != 0})
+		}
+		writeJSON(w, http.StatusOK, outputs)
+		return
+	}
+
+	outputName, found := outputNameFromTopic(name)
+	if !found {
+		writeJSONError(w, http.StatusNotFound, fmt.Sprintf("unknown output '%s'", name))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var update apiOutputUpdate
+		err := json.NewDecoder(r.Body).Decode(&update)
+		if err != nil || update.State == nil {
+			writeJSONError(w, http.StatusBadRequest, "expected {\"state\": ON|OFF|TOGGLE|true|false|1|0}")
+			return
+		}
+
+		payload := fmt.Sprint(update.State)
+		if _, err := parsePowerPayload(payload, 0); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		state, err := SetOutputPower(outputName, payload)
+		if _, refused := err.(*ProtectionError); refused {
+			writeJSONError(w, http.StatusConflict, err.Error())
+			return
+		} else if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		log.Printf("http: %s set %s to %d", r.RemoteAddr, outputName, state)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	state, _ := GetOutputState(outputName)
+	writeJSON(w, http.StatusOK, apiOutput{Name: outputName, State: state != 0})
+}
+
+func apiInputs(w http.ResponseWriter, r *http.Request) {
+	config := getConfig()
+
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	inputs := []apiInput{}
+	for _, in := range config.DigitalInputs {
+		state, _ := GetInputState(in.Name)
+		inputs = append(inputs, apiInput{Name: in.Name, Topic: inputTopicKey(config, in.Name), State: state})
+	}
+	writeJSON(w, http.StatusOK, inputs)
+}
+
+// apiSMS lists the pending and the last sent or failed SMS
+func apiSMS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, SMSQueueStatus())
+}
+
+func zoneToAPI(z *ThermostatZone) apiThermostat {
+	cfg := z.Config()
+	min, max, step := cfg.SetpointRange()
+	return apiThermostat{
+		Name:       cfg.Name,
+		Enabled:    cfg.Enabled,
+		Mode:       cfg.Mode,
+		Modes:      cfg.Modes(),
+		Setpoint:   cfg.Setpoint,
+		Min:        min,
+		Max:        max,
+		Step:       step,
+		Hysteresis: cfg.Hysteresis,
+		Actuator:   cfg.Actuator,
+		Cooling:    cfg.CoolingActuator,
+		Deadband:   cfg.Deadband,
+		Feedback:   cfg.FeedbackName,
+		Regulator:  cfg.Regulator,
+	}
+}
+
+// checkThermostatUpdate validates every field of a PUT body against the
+// zone config
+func checkThermostatUpdate(cfg Thermostat, update apiThermostatUpdate) error {
+	if update.Mode != nil {
+		mode := strings.ToLower(*update.Mode)
+		err := cfg.checkMode(mode)
+		if err != nil {
+			return fmt.Errorf("thermostat %s: %v", cfg.Name, err)
+		}
+		if update.Enabled != nil && *update.Enabled != isRegulatingMode(mode) {
+			return fmt.Errorf("enabled %v contradicts mode %s", *update.Enabled, mode)
+		}
+	}
+	if update.Setpoint != nil {
+		_, err := cfg.checkSetpoint(*update.Setpoint)
+		if err != nil {
+			return fmt.Errorf("thermostat %s: %v", cfg.Name, err)
+		}
+	}
+	if update.Hysteresis != nil && *update.Hysteresis < 0 {
+		return fmt.Errorf("hysteresis can not be negative")
+	}
+	return nil
+}
+
+// apiThermostatHandler serves /api/thermostats, /api/thermostats/{zone}
+// and /api/thermostat, the latter being the first zone
+func apiThermostatHandler(w http.ResponseWriter, r *http.Request) {
+
+	var zoneName string
+	if strings.HasPrefix(r.URL.Path, "/api/thermostats") {
+		zoneName = strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/thermostats"), "/")
+		if len(zoneName) == 0 {
+			if r.Method != http.MethodGet {
+				writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+				return
+			}
+			zones := []apiThermostat{}
+			for _, z := range getZones() {
+				zones = append(zones, zoneToAPI(z))
+			}
+			writeJSON(w, http.StatusOK, zones)
+			return
+		}
+	}
+
+	zone, found := FindZone(zoneName)
+	if !found {
+		writeJSONError(w, http.StatusNotFound, fmt.Sprintf("unknown thermostat '%s'", zoneName))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var update apiThermostatUpdate
+		err := json.NewDecoder(r.Body).Decode(&update)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		// Nothing is applied unless the whole update is valid
+		err = checkThermostatUpdate(zone.Config(), update)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		if update.Setpoint != nil {
+			err = zone.SetSetpoint(*update.Setpoint)
+		}
+		if err == nil && update.Hysteresis != nil {
+			err = zone.SetHysteresis(*update.Hysteresis)
+		}
+		if err == nil && update.Mode != nil {
+			err = zone.SetMode(*update.Mode)
+		} else if err == nil && update.Enabled != nil {
+			err = zone.SetEnabled(*update.Enabled)
+		}
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, zoneToAPI(zone))
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// version is set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+var (
+	configFlag   = flag.String("config", CONFIG_FILE_PATH, "config file path")
+	logFlag      = flag.String("log", "log/fortino.log", "log file path, \"-\" logs to stdout only")
+	logLevelFlag = flag.String("log-level", "info", "log level, info or debug")
+	dryRunFlag   = flag.Bool("dry-run", false, "use the simulated GPIO driver, no pin is touched")
+)
+
+var debugEnabled = false
+
+func setLogLevel(level string) error {
+	switch strings.ToLower(level) {
+	case "info":
+		debugEnabled = false
+	case "debug":
+		debugEnabled = true
+	default:
+		return fmt.Errorf("invalid log level '%s', expected info or debug", level)
+	}
+	return nil
+}
+
+// debugf logs only with -log-level debug
+func debugf(format string, v ...interface{}) {
+	if debugEnabled {
+		log.Printf(format, v...)
+	}
+}
+
+// applyFlags overrides the config with the command line flags, after
+// every load
+func applyFlags(c *FortinoConfig) {
+	if *dryRunFlag {
+		c.GPIO = "sim"
+	}
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "usage: %s [flags] [command]\n\n", os.Args[0])
+	fmt.Fprintln(out, "without a command fortino runs the daemon, commands are:")
+	fmt.Fprintln(out, "  version                 print the version")
+	fmt.Fprintln(out, "  check-config [FILE]     validate the config file, -config by default")
+	fmt.Fprintln(out, "  read-sensors [FILE]     read every configured sensor once")
+	fmt.Fprintln(out, "  set-output NAME on|off  drive an output, with the daemon stopped")
+	fmt.Fprintln(out, "\nflags:")
+	flag.PrintDefaults()
+}
+
+// runCommand runs a subcommand and returns the exit code
+func runCommand(args []string) int {
+	err := setLogLevel(*logLevelFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	// An optional config file after the command overrides -config
+	path := *configFlag
+	switch args[0] {
+	case "check-config", "read-sensors":
+		if len(args) > 2 {
+			fmt.Fprintf(os.Stderr, "usage: %s [FILE]\n", args[0])
+			return 2
+		} else if len(args) == 2 {
+			path = args[1]
+		}
+	case "version":
+		if len(args) > 1 {
+			fmt.Fprintln(os.Stderr, "usage: version")
+			return 2
+		}
+	}
+
+	switch args[0] {
+	case "version":
+		fmt.Printf("fortino %s\n", version)
+		return 0
+	case "check-config":
+		return checkConfigCommand(path)
+	case "read-sensors":
+		return readSensorsCommand(path)
+	case "set-output":
+		if len(args) != 3 {
+			fmt.Fprintln(os.Stderr, "usage: set-output NAME on|off")
+			return 2
+		}
+		return setOutputCommand(*configFlag, args[1], args[2])
+	}
+
+	fmt.Fprintf(os.Stderr, "unknown command '%s'\n\n", args[0])
+	usage()
+	return 2
+}
+
+// checkConfigCommand validates the config file, printing every error
+func checkConfigCommand(path string) int {
+	_, errs := ValidateConfigFile(path)
+	for _, err := range errs {
+		fmt.Println(err)
+	}
+	if len(errs) > 0 {
+		fmt.Printf("%s: %d errors\n", path, len(errs))
+		return 1
+	}
+	fmt.Printf("%s: ok\n", path)
+	return 0
+}
+
+func readSensorsCommand(path string) int {
+	config, err := LoadConfig(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	setConfig(config)
+
+	failed := 0
+	for _, s := range config.Onewires {
+		temp, err := ReadSensor(s)
+		if err != nil {
+			fmt.Printf("%-16s %-8s %-18s error: %v\n", s.Name, s.Type, s.ID, err)
+			failed++
+			continue
+		}
+		fmt.Printf("%-16s %-8s %-18s %.3f °C\n", s.Name, s.Type, s.ID, temp)
+	}
+
+	rpiInfo, err := RPI_GetInfo()
+	if err != nil {
+		fmt.Printf("%-16s error: %v\n", "RPI", err)
+	} else {
+		fmt.Printf("%-16s %-8s %-18s %s m°C\n", "RPI", "cpu", rpiInfo["cpu_serial"], rpiInfo["cpu_temp"])
+	}
+
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// setOutputCommand drives the pins of an output directly, the state is
+// neither saved nor published
+func setOutputCommand(path string, name string, payload string) int {
+	config, err := LoadConfig(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	applyFlags(&config)
+	setConfig(config)
+
+	outputName, found := outputNameFromTopic(name)
+	if !found {
+		fmt.Fprintf(os.Stderr, "unknown output '%s'\n", name)
+		return 1
+	}
+	state, err := parsePowerPayload(payload, 0)
+	if err != nil || strings.EqualFold(payload, "toggle") {
+		fmt.Fprintln(os.Stderr, "expected on or off")
+		return 2
+	}
+
+	gpio, err = NewGPIODriver(config.GPIO)
+	if err == nil {
+		err = gpio.Open()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer gpio.Close()
+
+	if g, isGroup := findOutputGroup(&config, outputName); isGroup {
+		for _, o := range config.DigitalOutputs {
+			if members := groupMembers(&config); members[o.Name] == g.Name {
+				gpio.SetOutput(o.PIN)
+			}
+		}
+		if err := driveGroup(g, state); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("%s: group %v set\n", g.Name, g.Members)
+		return 0
+	}
+
+	ok := true
+	for _, o := range config.DigitalOutputs {
+		if o.Name != outputName {
+			continue
+		}
+		gpio.SetOutput(o.PIN)
+		if writeOutputPin(o, state) {
+			fmt.Printf("%s: pin %d set\n", o.Name, o.PIN)
+		} else {
+			ok = false
+		}
+	}
+	if !ok {
+		return 1
+	}
+	return 0
+}
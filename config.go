@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// serializes reloads, from SIGHUP and from the file watcher
+var reloadMu sync.Mutex
+
+// LoadConfig reads and decodes a config file, then applies the secrets
+// file and the environment overrides
+func LoadConfig(path string) (FortinoConfig, error) {
+	c, errs := loadConfig(path)
+	if len(errs) > 0 {
+		return c, errs[0]
+	}
+	return c, nil
+}
+
+func loadConfig(path string) (FortinoConfig, []error) {
+	var c FortinoConfig
+
+	byteValue, err := ioutil.ReadFile(path)
+	if err != nil {
+		return c, []error{err}
+	}
+
+	err = json.Unmarshal(byteValue, &c)
+	if err != nil {
+		return c, []error{fmt.Errorf("%s: %v", path, err)}
+	}
+
+	err = applySecrets(&c, path)
+	if err != nil {
+		return c, []error{err}
+	}
+	return c, applyEnv(&c, os.Environ())
+}
+
+// ReloadConfig reads the config file again and applies what changed,
+// outputs whose pin didn't change are left untouched. On errors the
+// running config is kept.
+func ReloadConfig(path string) error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	newConfig, errs := ValidateConfigFile(path)
+	if len(errs) > 0 {
+		for _, err := range errs {
+			log.Printf("reload: %v", err)
+		}
+		log.Println("reload: keeping the running config")
+		return errs[0]
+	}
+
+	applyFlags(&newConfig)
+	oldConfig := getConfig()
+
+	// These are only read at startup
+	if newConfig.UpdateInterval < 3 {
+		newConfig.UpdateInterval = 3
+	}
+	if newConfig.GPIO != oldConfig.GPIO {
+		log.Println("reload: gpio_driver changes need a restart")
+		newConfig.GPIO = oldConfig.GPIO
+	}
+	if !reflect.DeepEqual(newConfig.HTTP, oldConfig.HTTP) {
+		log.Println("reload: http changes need a restart")
+		newConfig.HTTP = oldConfig.HTTP
+	}
+	if newConfig.UpdateInterval != oldConfig.UpdateInterval {
+		log.Println("reload: update_interval changes need a restart")
+		newConfig.UpdateInterval = oldConfig.UpdateInterval
+	}
+
+	// Outputs by name and pin, groups when they or a member changed
+	io_init := ""
+	members := groupMembers(&newConfig)
+	for _, o := range newConfig.DigitalOutputs {
+		old, found := findOutputConfig(oldConfig.DigitalOutputs, o.Name, o.PIN)
+		if _, grouped := members[o.Name]; grouped || (found && old.InvertedLogic == o.InvertedLogic) {
+			continue
+		}
+		io_init = io_init + initOutput(o)
+	}
+	changedGroups := []OutputGroupConfig{}
+	for _, g := range newConfig.OutputGroups {
+		old, found := findOutputGroup(oldConfig, g.Name)
+		changed := !found || !reflect.DeepEqual(old, g)
+		for _, o := range newConfig.DigitalOutputs {
+			if members[o.Name] != g.Name {
+				continue
+			}
+			old, found := findOutputConfig(oldConfig.DigitalOutputs, o.Name, o.PIN)
+			changed = changed || !found || old.InvertedLogic != o.InvertedLogic
+		}
+		if changed {
+			changedGroups = append(changedGroups, g)
+		}
+	}
+	for _, o := range oldConfig.DigitalOutputs {
+		if _, found := findOutputConfig(newConfig.DigitalOutputs, o.Name, o.PIN); !found {
+			log.Printf("reload: output %s on pin %d removed, left as it is", o.Name, o.PIN)
+		}
+	}
+	names := map[string]bool{}
+	for _, name := range outputNames(&newConfig) {
+		names[name] = true
+	}
+	outputStatesMu.Lock()
+	for name := range outputStates {
+		if !names[name] {
+			delete(outputStates, name)
+		}
+	}
+	outputStatesMu.Unlock()
+
+	mqttChanged := !reflect.DeepEqual(newConfig.MQTT, oldConfig.MQTT)
+	client := getMQTTClient()
+	if mqttChanged {
+		if oldConfig.HomeAssistant.Enabled {
+			RemoveHADiscovery(client)
+		}
+		disconnectMQTT()
+	} else if oldConfig.HomeAssistant.Enabled && !newConfig.HomeAssistant.Enabled {
+		RemoveHADiscovery(client)
+	}
+
+	setConfig(newConfig)
+
+	// Groups find their member pins in the running config
+	for _, g := range changedGroups {
+		io_init = io_init + initGroup(g)
+	}
+	if len(io_init) > 0 {
+		log.Println("reload: digital I/O init:" + io_init)
+	}
+
+	reloadZones()
+
+	if newConfig.HiLinkConfig.Enable {
+		startHiLinkRoutine()
+	}
+	if newConfig.WatchConfig {
+		startConfigWatchRoutine(path)
+	}
+	if len(newConfig.DigitalInputs) > 0 {
+		startInputRoutine()
+	}
+	syncRuleStates()
+	if len(newConfig.Rules) > 0 {
+		startRulesRoutine()
+	}
+
+	if mqttChanged {
+		log.Println("mqtt: reconnecting with the new settings")
+		connectMQTT()
+	} else {
+		// A new connection does all this in mqttOnConnectHandler
+		for _, z := range getZones() {
+			z.publishSetpoint()
+			z.publishMode()
+		}
+		if newConfig.HomeAssistant.Enabled && client != nil && client.IsConnected() {
+			PublishHADiscovery(client)
+		}
+		subscribeRuleTopics(client, false)
+		PublishRulesState()
+	}
+
+	SaveState()
+	log.Println("configuration reloaded")
+	return nil
+}
+
+// findOutputConfig looks an output up by name and pin
+func findOutputConfig(outputs []DigitalOutputConfig, name string, pin byte) (DigitalOutputConfig, bool) {
+	for _, o := range outputs {
+		if o.Name == name && o.PIN == pin {
+			return o, true
+		}
+	}
+	return DigitalOutputConfig{}, false
+}
+
+// reloadZones restarts the zones whose config changed, starts the new
+// ones and stops the removed ones, switching their actuators off
+func reloadZones() {
+	zones := []*ThermostatZone{}
+	kept := map[*ThermostatZone]bool{}
+
+	for _, t := range ThermostatConfigs(getConfig()) {
+		z, found := FindZone(t.Name)
+		if found && z.Name() == t.Name {
+			kept[z] = true
+			if z.Reconfigure(t) {
+				log.Printf("thermostat %s: config changed, restarting", t.Name)
+				z.Stop(false)
+				z.Start()
+			}
+		} else {
+			log.Printf("thermostat %s: added", t.Name)
+			z = NewThermostatZone(t)
+			z.Start()
+		}
+		zones = append(zones, z)
+	}
+
+	for _, z := range getZones() {
+		if !kept[z] {
+			log.Printf("thermostat %s: removed", z.Name())
+			z.Stop(true)
+			z.clearRetained()
+		}
+	}
+
+	setZones(zones)
+}
+
+var configWatchOnce sync.Once
+
+// startConfigWatchRoutine starts ConfigWatchRoutine once, it then
+// follows the watch_config flag across reloads
+func startConfigWatchRoutine(path string) {
+	configWatchOnce.Do(func() {
+		go ConfigWatchRoutine(path)
+	})
+}
+
+// ConfigWatchRoutine reloads the config when the file modification time
+// or size change
+func ConfigWatchRoutine(path string) {
+	log.Printf("watching %s for changes", path)
+
+	var lastModTime time.Time
+	var lastSize int64
+	if info, err := os.Stat(path); err == nil {
+		lastModTime, lastSize = info.ModTime(), info.Size()
+	}
+
+	for {
+		time.Sleep(time.Second * 5)
+
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if info.ModTime().Equal(lastModTime) && info.Size() == lastSize {
+			continue
+		}
+		lastModTime, lastSize = info.ModTime(), info.Size()
+
+		if !getConfig().WatchConfig {
+			continue
+		}
+		log.Printf("%s changed", path)
+		ReloadConfig(path)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Environment overrides are FORTINO_ followed by the json path of the
+// field, upper case with "_" between levels and list indexes, es.
+// FORTINO_MQTT_PASSWORD or FORTINO_OUTPUTS_0_PIN. A _FILE suffix reads
+// the value from a file, es. FORTINO_MQTT_PASSWORD_FILE.
+const envPrefix = "FORTINO_"
+
+var envNameRegex = regexp.MustCompile(`[^A-Z0-9]+`)
+
+// secretsFilePath returns the secrets file, relative paths are relative
+// to the config file
+func secretsFilePath(c *FortinoConfig, configPath string) string {
+	path := c.SecretsFile
+	if p, ok := os.LookupEnv(envPrefix + "SECRETS_FILE"); ok {
+		path = p
+	}
+	if len(path) > 0 && !filepath.IsAbs(path) {
+		path = filepath.Join(filepath.Dir(configPath), path)
+	}
+	return path
+}
+
+// applySecrets merges the secrets file over the config, objects are
+// merged field by field and lists are replaced
+func applySecrets(c *FortinoConfig, configPath string) error {
+	path := secretsFilePath(c, configPath)
+	if len(path) == 0 {
+		return nil
+	}
+
+	byteValue, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(byteValue, c)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+// applyEnv sets the config fields named by the FORTINO_ variables in
+// environ. Variables matching no field are only logged, the environment
+// can carry FORTINO_ variables meant for something else.
+func applyEnv(c *FortinoConfig, environ []string) []error {
+	var errs []error
+
+	fields := map[string]reflect.Value{}
+	envFields("", reflect.ValueOf(c).Elem(), fields)
+
+	sort.Strings(environ)
+	for _, kv := range environ {
+		if !strings.HasPrefix(kv, envPrefix) {
+			continue
+		}
+		eq := strings.Index(kv, "=")
+		if eq < 0 {
+			continue
+		}
+		name, value := kv[:eq], kv[eq+1:]
+		key := strings.TrimPrefix(name, envPrefix)
+
+		field, found := fields[key]
+		if !found && strings.HasSuffix(key, "_FILE") {
+			field, found = fields[strings.TrimSuffix(key, "_FILE")]
+			if found {
+				byteValue, err := ioutil.ReadFile(value)
+				if err != nil {
+					errs = append(errs, fmt.Errorf("%s: %v", name, err))
+					continue
+				}
+				value = strings.TrimRight(string(byteValue), "\r\n")
+			}
+		}
+		if !found {
+			log.Printf("config: ignoring %s, no such config field", name)
+			continue
+		}
+
+		err := setFromString(field, value)
+		if err != nil {
+			// The value could be a secret, it's not in the error
+			errs = append(errs, fmt.Errorf("%s: invalid %s value", name, field.Type()))
+		}
+	}
+	return errs
+}
+
+// envFields collects the settable fields of v by environment name,
+// maps are not supported
+func envFields(prefix string, v reflect.Value, fields map[string]reflect.Value) {
+	switch v.Kind() {
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if len(f.PkgPath) > 0 {
+				continue
+			}
+			name := f.Name
+			if tag := strings.Split(f.Tag.Get("json"), ",")[0]; tag == "-" {
+				continue
+			} else if len(tag) > 0 {
+				name = tag
+			}
+			envFields(joinEnvName(prefix, name), v.Field(i), fields)
+		}
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Struct {
+			for i := 0; i < v.Len(); i++ {
+				envFields(joinEnvName(prefix, strconv.Itoa(i)), v.Index(i), fields)
+			}
+			return
+		}
+		fields[prefix] = v
+	case reflect.Map:
+	default:
+		fields[prefix] = v
+	}
+}
+
+func joinEnvName(prefix string, name string) string {
+	name = strings.Trim(envNameRegex.ReplaceAllString(strings.ToUpper(name), "_"), "_")
+	if len(prefix) == 0 {
+		return name
+	}
+	return prefix + "_" + name
+}
+
+// setFromString parses value into the field, lists are comma separated
+func setFromString(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.Ptr:
+		elem := reflect.New(field.Type().Elem())
+		err := setFromString(elem.Elem(), value)
+		if err != nil {
+			return err
+		}
+		field.Set(elem)
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(value, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(value, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(value, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	case reflect.Slice:
+		list := reflect.MakeSlice(field.Type(), 0, 0)
+		for _, item := range strings.Split(value, ",") {
+			elem := reflect.New(field.Type().Elem()).Elem()
+			err := setFromString(elem, strings.TrimSpace(item))
+			if err != nil {
+				return err
+			}
+			list = reflect.Append(list, elem)
+		}
+		field.Set(list)
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestApplyEnv(t *testing.T) {
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(passwordFile, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c := FortinoConfig{DigitalOutputs: []DigitalOutputConfig{{Name: "POWER1", PIN: 5}}}
+	errs := applyEnv(&c, []string{
+		"HOME=/root",
+		"FORTINO_MQTT_HOST=broker.lan",
+		"FORTINO_MQTT_PORT=8883",
+		"FORTINO_MQTT_PASSWORD_FILE=" + passwordFile,
+		"FORTINO_OUTPUTS_0_PIN=17",
+		"FORTINO_OUTPUTS_0_INVERTED_LOGIC=true",
+		"FORTINO_HILINK_CONFIG_ALLOWED_PHONES=+391,+392",
+		"FORTINO_NO_SUCH_FIELD=1",
+	})
+	if len(errs) > 0 {
+		t.Fatalf("errors: %v", errs)
+	}
+
+	if c.MQTT.Host != "broker.lan" || c.MQTT.Port != 8883 {
+		t.Errorf("mqtt = %s:%d, want broker.lan:8883", c.MQTT.Host, c.MQTT.Port)
+	}
+	if c.MQTT.Password != "s3cret" {
+		t.Errorf("password from file = %q, want s3cret", c.MQTT.Password)
+	}
+	if o := c.DigitalOutputs[0]; o.PIN != 17 || !o.InvertedLogic {
+		t.Errorf("output = pin %d inverted %v, want pin 17 inverted", o.PIN, o.InvertedLogic)
+	}
+	if phones := c.HiLinkConfig.AllowedPhones; len(phones) != 2 || phones[0] != "+391" || phones[1] != "+392" {
+		t.Errorf("allowed phones = %v, want [+391 +392]", phones)
+	}
+}
+
+func TestApplyEnvErrors(t *testing.T) {
+	tests := []string{
+		"FORTINO_MQTT_PORT=high",
+		"FORTINO_OUTPUTS_0_PIN=300",
+		"FORTINO_WATCH_CONFIG=sometimes",
+		"FORTINO_MQTT_PASSWORD_FILE=/no/such/file",
+	}
+	for _, kv := range tests {
+		c := FortinoConfig{DigitalOutputs: []DigitalOutputConfig{{Name: "POWER1", PIN: 5}}}
+		if errs := applyEnv(&c, []string{kv}); len(errs) != 1 {
+			t.Errorf("%s: %d errors, want 1", kv, len(errs))
+		}
+	}
+}
@@ -2,27 +2,60 @@ package main
 
 import (
 	"encoding/json"
-	"errors"
+	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"os"
 	"os/signal"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
-	"github.com/stianeikeland/go-rpio/v4"
 )
 
 const CONFIG_FILE_PATH = "config.json"
 const MQTT_DATETIME_FORMAT = "2006-01-02T15:04:05"
 
-var config FortinoConfig
+// running config, a *FortinoConfig replaced as a whole on reload. Readers
+// take it once with getConfig and never modify it.
+var runningConfig atomic.Value
+
+func getConfig() *FortinoConfig {
+	return runningConfig.Load().(*FortinoConfig)
+}
+
+func setConfig(c FortinoConfig) {
+	runningConfig.Store(&c)
+}
+
+func init() {
+	setConfig(FortinoConfig{})
+}
+
+// replaced by connectMQTT, nil until the first connection
 var mqttClient mqtt.Client
+var mqttClientMu sync.RWMutex
+
+func getMQTTClient() mqtt.Client {
+	mqttClientMu.RLock()
+	defer mqttClientMu.RUnlock()
+	return mqttClient
+}
+
+// last state set on each output, by output name
+var outputStates = map[string]int{}
+var outputStatesMu sync.Mutex
+
+// one lock per output or group, held from the protection check to the
+// record of the switch
+var outputLocks = map[string]*sync.Mutex{}
+var outputLocksMu sync.Mutex
 
 type FortinoConfig struct {
 	MQTT struct {
@@ -33,8 +66,13 @@ type FortinoConfig struct {
 		Username  string
 		Password  string
 	}
+	GPIO           string                `json:"gpio_driver"`
+	SysfsRoot      string                `json:"sysfs_root"`
+	StateFile      string                `json:"state_file"`
 	UpdateInterval int                   `json:"update_interval"`
 	DigitalOutputs []DigitalOutputConfig `json:"outputs"`
+	OutputGroups   []OutputGroupConfig   `json:"output_groups"`
+	DigitalInputs  []DigitalInputConfig  `json:"inputs"`
 
 	Onewires []OneWireSensor `json:"onewire"`
 	//HiLinkSMSGatewayEnabled       bool
@@ -43,7 +81,20 @@ type FortinoConfig struct {
 
 	HiLinkConfig HiLinkConfig `json:"hilink_config"`
 
-	Thermostat Thermostat `json:"thermostat"`
+	Thermostat  Thermostat   `json:"thermostat"`
+	Thermostats []Thermostat `json:"thermostats"`
+
+	Rules []RuleConfig `json:"rules"`
+
+	HomeAssistant HomeAssistantConfig `json:"homeassistant"`
+
+	HTTP HTTPConfig `json:"http"`
+
+	// Reload the config when the file changes, SIGHUP always reloads it
+	WatchConfig bool `json:"watch_config"`
+
+	// json file merged over this config, to keep credentials apart
+	SecretsFile string `json:"secrets_file"`
 }
 
 type DigitalOutputConfig struct {
@@ -52,12 +103,20 @@ type DigitalOutputConfig struct {
 	PIN           byte
 	InvertedLogic bool `json:"inverted_logic"`
 	State         bool `json:"initial"`
+	RestoreState  bool `json:"restore_state"`
+	// ID is unused, it is accepted so configs written for the old sample,
+	// that had one per output, still validate
+	ID string `json:"id"`
+
+	Protection ProtectionConfig `json:"protection"`
 }
 
 type OneWireSensor struct {
 	Name string
 	ID   string
 	Type string
+
+	Alarms SensorAlarmConfig `json:"alarms"`
 }
 
 type SensorSample struct {
@@ -69,6 +128,19 @@ type SensorSample struct {
 	SampledAt time.Time
 }
 
+// sensorTeleKeys returns the key of each sensor in the SENSOR telemetry,
+// sensors are numbered by type in config order, es. DS18B20-1, DS18B20-2...
+func sensorTeleKeys() map[string]string {
+	keys := map[string]string{}
+	typeIndex := map[string]int{}
+	for _, s := range getConfig().Onewires {
+		sensorType := strings.ToUpper(s.Type)
+		typeIndex[sensorType] = typeIndex[sensorType] + 1
+		keys[s.Name] = fmt.Sprintf("%s-%d", sensorType, typeIndex[sensorType])
+	}
+	return keys
+}
+
 func SensorSamplingRoutine(samplingInterval int) {
 
 	for {
@@ -76,19 +148,16 @@ func SensorSamplingRoutine(samplingInterval int) {
 		jsonObj := map[string]interface{}{}
 		jsonObj["Time"] = time.Now().UTC().Format(MQTT_DATETIME_FORMAT)
 
-		// DS18B20...
-		ds18BIndex := 1
-		for _, s := range config.Onewires {
+		sensorKeys := sensorTeleKeys()
+		for _, s := range getConfig().Onewires {
 
-			if s.Type != "DS18B20" {
-				continue
-			}
-
-			temp, err := ReadTemp_DS18B20(s.ID)
+			temp, err := ReadSensor(s)
 			if err != nil {
 				// Silently ignores sampling errors...
+				StoreSample(SensorSample{Name: s.Name, Type: s.Type, Status: "error", SampledAt: time.Now().UTC()})
 				continue
 			}
+			StoreSample(SensorSample{Name: s.Name, Type: s.Type, Status: "ok", fValue: temp, SampledAt: time.Now().UTC()})
 
 			var betterID string
 			minusIndex := strings.Index(s.ID, "-")
@@ -99,11 +168,10 @@ func SensorSamplingRoutine(samplingInterval int) {
 			}
 
 			// JSON Object update
-			jsonObj[fmt.Sprintf("DS18B20-%d", ds18BIndex)] = map[string]interface{}{
+			jsonObj[sensorKeys[s.Name]] = map[string]interface{}{
 				"Id":          strings.ToUpper(betterID),
 				"Temperature": float64(int(temp*100)) / 100.0,
 			}
-			ds18BIndex = ds18BIndex + 1
 		}
 
 		// RPI
@@ -120,115 +188,354 @@ func SensorSamplingRoutine(samplingInterval int) {
 				"Id":          rpiInfo["cpu_serial"],
 				"Temperature": (float64(cpuTemp) / 1000.0),
 			}
+			StoreSample(SensorSample{Name: "RPI", Type: "cpu", Status: "ok", fValue: float64(cpuTemp) / 1000.0, SampledAt: time.Now().UTC()})
 		}
 
 		jsonStr, err := json.Marshal(jsonObj)
 		if err != nil {
 			log.Fatal(err)
 		}
-		topic := fmt.Sprintf("tele/%s/SENSOR", config.MQTT.Topic)
-		mqttClient.Publish(topic, 0, false, jsonStr)
+		topic := fmt.Sprintf("tele/%s/SENSOR", getConfig().MQTT.Topic)
+		getMQTTClient().Publish(topic, 0, false, jsonStr)
 
 		time.Sleep(time.Second * time.Duration(samplingInterval))
 	}
 }
 
-func ReadTemp_DS18B20(ID string) (float64, error) {
+var mqttCallback mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
 
-	w1BusPath := fmt.Sprintf("/sys/bus/w1/devices/%s/w1_slave", ID)
-	dat, err := os.ReadFile(w1BusPath)
-	if err != nil {
-		log.Printf("%s", string(err.Error()))
-		return -10000, err
+	lowerTopic := strings.ToLower(msg.Topic())
+
+	if strings.HasSuffix(lowerTopic, "/temptargetset") {
+		rawFloat := string(msg.Payload())
+
+		zone, err := zoneFromCommandTopic(msg.Topic())
+		if err != nil {
+			log.Printf("TEMPTARGETSET %v", err)
+			return
+		}
+
+		s, duration, err := parseSetpointPayload(rawFloat)
+		if err != nil {
+			log.Printf("TEMPTARGETSET Failed to parse temp setpoint '%s'", rawFloat)
+			PublishResult("TEMPTARGETSET", err)
+			return
+		}
+
+		err = zone.SetSetpointFor(s, duration)
+		if err != nil {
+			log.Println(err)
+			PublishResult("TEMPTARGETSET", err)
+		}
+
+		return
+	} else if strings.HasSuffix(lowerTopic, "/preset") {
+		zone, err := zoneFromCommandTopic(msg.Topic())
+		if err != nil {
+			log.Printf("PRESET %v", err)
+			return
+		}
+
+		fields := strings.Fields(string(msg.Payload()))
+		if len(fields) == 0 {
+			log.Println("PRESET missing preset name")
+			return
+		}
+
+		duration, err := parseOverrideDuration(fields[1:])
+		if err != nil {
+			log.Printf("PRESET %v", err)
+			return
+		}
+
+		err = zone.SetPreset(fields[0], duration)
+		if err != nil {
+			log.Println(err)
+			PublishResult("PRESET", err)
+		}
+
+		return
+	} else if strings.HasSuffix(lowerTopic, "/thermostat") || strings.HasSuffix(lowerTopic, "/mode") {
+		zone, err := zoneFromCommandTopic(msg.Topic())
+		if err != nil {
+			log.Printf("THERMOSTAT %v", err)
+			return
+		}
+
+		payload := strings.ToLower(strings.TrimSpace(string(msg.Payload())))
+		if len(payload) == 0 {
+			zone.publishMode()
+			return
+		}
+
+		if strings.HasSuffix(lowerTopic, "/thermostat") {
+			enabled := 0
+			if zone.Config().Enabled {
+				enabled = 1
+			}
+			enabled, err = parsePowerPayload(payload, enabled)
+			if err == nil {
+				err = zone.SetEnabled(enabled != 0)
+			}
+		} else {
+			err = zone.SetMode(payload)
+		}
+		if err != nil {
+			log.Println(err)
+			PublishResult(strings.ToUpper(lowerTopic[strings.LastIndex(lowerTopic, "/")+1:]), err)
+		}
+
+		return
+	} else if strings.HasSuffix(lowerTopic, "/rule") {
+		// RULE <name> ON|OFF|TOGGLE, empty publishes the rules state
+		fields := strings.Fields(string(msg.Payload()))
+		if len(fields) == 0 {
+			PublishRulesState()
+			return
+		}
+		if len(fields) != 2 {
+			log.Println("RULE expected <name> ON|OFF|TOGGLE")
+			return
+		}
+
+		enabled, ok := RuleEnabled(fields[0])
+		if !ok {
+			err := fmt.Errorf("unknown rule '%s'", fields[0])
+			log.Printf("RULE %v", err)
+			PublishResult("RULE", err)
+			return
+		}
+		current := 0
+		if enabled {
+			current = 1
+		}
+		state, err := parsePowerPayload(fields[1], current)
+		if err == nil {
+			err = SetRuleEnabled(fields[0], state != 0)
+		}
+		if err != nil {
+			log.Printf("RULE %v", err)
+			PublishResult("RULE", err)
+		}
+
+		return
+	} else if outputName, ok := outputNameFromTopic(msg.Topic()); ok {
+		payload := strings.TrimSpace(string(msg.Payload()))
+		if len(payload) == 0 {
+			// Empty payload only asks for the current state
+			current, _ := GetOutputState(outputName)
+			PublishOutputState(outputName, current)
+			return
+		}
+
+		_, err := SetOutputPower(outputName, payload)
+		if _, refused := err.(*ProtectionError); refused {
+			log.Println(err)
+		} else if err != nil {
+			log.Printf("mqtt: %s: %v", outputName, err)
+		}
+
+		return
+	} else {
+		fmt.Printf("TOPIC: %s\n", msg.Topic())
+		fmt.Printf("MSG: %s\n", msg.Payload())
 	}
+}
 
-	lines := strings.Split(string(dat), "\n")
-	if len(lines) < 2 {
-		log.Println("onewire: invalid DS18B20 bus payload")
-		return -10010, errors.New("invalid DS18B20 bus payload")
+// outputNameFromTopic matches the last level of a command topic (es.
+// cmnd/fortino/POWER1) against the configured outputs and groups, case
+// insensitive. Outputs in a group only switch with the group.
+func outputNameFromTopic(topic string) (string, bool) {
+	cmnd := topic[strings.LastIndex(topic, "/")+1:]
+	for _, name := range outputNames(getConfig()) {
+		if strings.EqualFold(name, cmnd) {
+			return name, true
+		}
 	}
+	return "", false
+}
 
-	if !strings.HasSuffix(strings.TrimRight(lines[0], "\r\n"), "YES") {
-		log.Println("onewire: invalid DS18B20 CRC")
-		return -10020, errors.New("invalid DS18B20 CRC")
+// parsePowerPayload converts a Tasmota style POWER payload to an output
+// state, current is used to resolve TOGGLE.
+func parsePowerPayload(payload string, current int) (int, error) {
+	switch strings.ToLower(strings.TrimSpace(payload)) {
+	case "on", "1", "true":
+		return 1, nil
+	case "off", "0", "false":
+		return 0, nil
+	case "toggle":
+		if current == 0 {
+			return 1, nil
+		}
+		return 0, nil
 	}
+	return current, fmt.Errorf("invalid power payload '%s'", payload)
+}
 
-	if strings.Count(lines[1], "=") != 1 {
-		log.Println("onewire: invalid DS18B20 format")
-		return -10030, errors.New("invalid DS18B20 fortmat")
+// lockOutputs takes the locks of the outputs in name order and returns
+// the function releasing them
+func lockOutputs(names ...string) func() {
+	names = append([]string{}, names...)
+	sort.Strings(names)
+
+	var locks []*sync.Mutex
+	outputLocksMu.Lock()
+	for i, name := range names {
+		if i > 0 && names[i-1] == name {
+			continue
+		}
+		l, ok := outputLocks[name]
+		if !ok {
+			l = &sync.Mutex{}
+			outputLocks[name] = l
+		}
+		locks = append(locks, l)
 	}
+	outputLocksMu.Unlock()
 
-	equalSignIndex := strings.Index(lines[1], "=")
-	if equalSignIndex > 0 {
-		tempInMilliC := lines[1][(equalSignIndex + 1):len(lines[1])]
-		tempInMilli, err := strconv.Atoi(tempInMilliC)
-		if err != nil {
-			return -10040, err
+	for _, l := range locks {
+		l.Lock()
+	}
+	return func() {
+		for i := len(locks) - 1; i >= 0; i-- {
+			locks[i].Unlock()
 		}
-		return float64(tempInMilli) / 1000.0, nil
 	}
+}
 
-	panic("onewire: counted 1 equal sign, found none")
+// lockOutput locks the output and, for a group, the groups it interlocks
+// with, so that two of them can't pass the interlock check together
+func lockOutput(outputName string) func() {
+	names := []string{outputName}
+	if g, isGroup := findOutputGroup(getConfig(), outputName); isGroup {
+		names = append(names, g.Interlock...)
+	}
+	return lockOutputs(names...)
 }
 
-func RPI_GetInfo() (map[string]string, error) {
+func GetOutputState(outputName string) (int, bool) {
+	outputStatesMu.Lock()
+	defer outputStatesMu.Unlock()
+	state, ok := outputStates[outputName]
+	return state, ok
+}
 
-	dict := make(map[string]string)
+func PublishOutputState(outputName string, state int) {
+	client := getMQTTClient()
+	if client == nil {
+		return
+	}
 
-	dat, err := os.ReadFile("/proc/cpuinfo")
-	if err != nil {
-		return dict, err
+	var payload string
+	if state == 0 {
+		payload = "false"
+	} else {
+		payload = "true"
 	}
+	pubToken := client.Publish(
+		fmt.Sprintf("stat/%s/%s", getConfig().MQTT.Topic, outputName),
+		0,
+		false,
+		payload,
+	)
+	if pubToken.WaitTimeout(time.Second); pubToken.Error() != nil {
+		log.Printf("mqtt: error publishing token")
+		log.Println(pubToken.Error())
+	}
+}
 
-	lines := strings.Split(string(dat), "\n")
-	for _, l := range lines {
-		if strings.HasPrefix(l, "Serial") {
-			t := strings.Split(l, ":")
-			if len(t) < 2 {
-				panic("/proc/cpuinfo Serial : wrong format")
-			}
-			dict["cpu_serial"] = strings.Trim(t[1], " ")
-		}
+// PublishResult reports a failed command back on stat/<topic>/RESULT,
+// es. {"TEMPTARGETSET":{"Error":"..."}}
+func PublishResult(command string, err error) {
+	client := getMQTTClient()
+	if client == nil {
+		return
+	}
+
+	jsonStr, jsonErr := json.Marshal(map[string]interface{}{
+		command: map[string]string{"Error": err.Error()},
+	})
+	if jsonErr != nil {
+		log.Println(jsonErr)
+		return
 	}
+	client.Publish(fmt.Sprintf("stat/%s/RESULT", getConfig().MQTT.Topic), 0, false, jsonStr)
+}
+
+// SetOutputState drives the output, unless its protection refuses the
+// switch with a *ProtectionError
+func SetOutputState(outputName string, state int) error {
+	return setOutputState(outputName, state, false)
+}
+
+// SetOutputPower applies a POWER payload to the output and returns the
+// new state, TOGGLE reads the current state under the output lock. It is
+// an explicit command, so it releases an output latched off by max_on.
+func SetOutputPower(outputName string, payload string) (int, error) {
+	unlock := lockOutput(outputName)
+	defer unlock()
 
-	dat, err = os.ReadFile("/sys/class/thermal/thermal_zone0/temp")
+	releaseMaxOnLatch(outputName)
+	current, _ := GetOutputState(outputName)
+	state, err := parsePowerPayload(payload, current)
 	if err != nil {
-		return dict, err
+		return current, err
 	}
-	dict["cpu_temp"] = strings.Trim(string(dat), "\n")
+	return state, switchOutput(outputName, state, false)
+}
 
-	return dict, nil
+// outputPinLevel is the pin level for the output state, true is high
+func outputPinLevel(o DigitalOutputConfig, state int) bool {
+	return !((state == 0 && !o.InvertedLogic) || (state == 1 && o.InvertedLogic))
 }
 
-var mqttCallback mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
+// writeOutputPin drives the output pin and checks the feedback
+func writeOutputPin(o DigitalOutputConfig, state int) bool {
+	pinStateRef := outputPinLevel(o, state)
 
-	lowerTopic := strings.ToLower(msg.Topic())
+	gpio.Write(o.PIN, pinStateRef)
+	time.Sleep(time.Second)
+	pinState := gpio.Read(o.PIN)
+	if pinState != pinStateRef {
+		log.Printf("PIN %d set to %s but feedback is %s\n", o.PIN, levelName(pinStateRef), levelName(pinState))
+		return false
+	}
+	debugf("output %d %s", o.PIN, levelName(pinState))
+	return true
+}
 
-	if strings.HasSuffix(lowerTopic, "/temptargetset") {
-		rawFloat := string(msg.Payload())
+// setOutputState with force skips the protection checks
+func setOutputState(outputName string, state int, force bool) error {
+	unlock := lockOutput(outputName)
+	defer unlock()
+
+	return switchOutput(outputName, state, force)
+}
 
-		s, err := strconv.ParseFloat(rawFloat, 64)
+// switchOutput does the switch, the caller holds the output lock
+func switchOutput(outputName string, state int, force bool) error {
+	config := getConfig()
+
+	debugf("outputstate %s -> %d", outputName, state)
+
+	current, known := GetOutputState(outputName)
+	if known && !force {
+		err := checkProtection(outputName, current, state, time.Now().UTC())
 		if err != nil {
-			log.Printf("TEMPTARGETSET Failed to parse temp setpoint '%s'", rawFloat)
+			return err
 		}
+	}
 
-		err = ThermoSetpoint(s)
+	nameMatched := false
+
+	if g, isGroup := findOutputGroup(config, outputName); isGroup {
+		err := driveGroup(g, state)
 		if err != nil {
 			log.Println(err)
 		}
-
-		return
-	} else {
-		fmt.Printf("TOPIC: %s\n", msg.Topic())
-		fmt.Printf("MSG: %s\n", msg.Payload())
+		PublishGroupFeedback(g.Name, err == nil)
+		nameMatched = true
 	}
-}
-
-func SetOutputState(outputName string, state int) error {
-
-	// log.Printf("outputstate %s -> %d", outputName, state)
-
-	nameMatched := false
 
 	for _, o := range config.DigitalOutputs {
 
@@ -236,28 +543,7 @@ func SetOutputState(outputName string, state int) error {
 			continue
 		}
 
-		pin := rpio.Pin(o.PIN)
-
-		var pinStateRef rpio.State
-		if (state == 0 && !o.InvertedLogic) || (state == 1 && o.InvertedLogic) {
-			pin.Write(rpio.Low)
-			pinStateRef = rpio.Low
-		} else {
-
-			pinStateRef = rpio.High
-		}
-
-		pin.Write(pinStateRef)
-		time.Sleep(time.Second)
-		pinState := pin.Read()
-		if pinState != pinStateRef {
-			log.Printf("PIN %d set to %d but feedback is %d\n", pin, pinStateRef, pinState)
-		}
-		/*if pinState == rpio.High {
-			log.Printf("output %d high", o.PIN)
-		} else {
-			log.Printf("output %d low", o.PIN)
-		}*/
+		writeOutputPin(o, state)
 
 		nameMatched = true
 	}
@@ -265,48 +551,166 @@ func SetOutputState(outputName string, state int) error {
 	if !nameMatched {
 		log.Printf("error outname name '%s' didn't match any actuators", outputName)
 	} else {
-		var payload string
-		if state == 0 {
-			payload = "false"
-		} else {
-			payload = "true"
-		}
-		pubToken := mqttClient.Publish(
-			fmt.Sprintf("stat/%s/%s", config.MQTT.Topic, outputName),
-			0,
-			false,
-			payload,
-		)
-		if pubToken.WaitTimeout(time.Second); pubToken.Error() != nil {
-			log.Printf("mqtt: error publishing token")
-			log.Println(pubToken.Error())
+		outputStatesMu.Lock()
+		outputStates[outputName] = state
+		outputStatesMu.Unlock()
+
+		if !known || current != state {
+			recordSwitch(outputName, state, time.Now().UTC())
 		}
+
+		SaveState()
+		PublishOutputState(outputName, state)
 	}
 
 	return nil
 }
 
+// initOutput configures the pin and drives it to the output initial
+// state, returning the log line fragment
+func initOutput(o DigitalOutputConfig) string {
+	gpio.SetOutput(o.PIN)
+
+	state := 0
+	if o.State {
+		state = 1
+	}
+	outputStatesMu.Lock()
+	outputStates[o.Name] = state
+	outputStatesMu.Unlock()
+	// Protection times start from boot, a restart after a power
+	// blip waits min_off like any other switch
+	recordSwitch(o.Name, state, time.Now().UTC())
+
+	if outputPinLevel(o, state) {
+		gpio.Write(o.PIN, true)
+		return fmt.Sprintf(" pin %d OUT [HIGH]", o.PIN)
+	}
+	gpio.Write(o.PIN, false)
+	return fmt.Sprintf(" pin %d OUT [LOW]", o.PIN)
+}
+
+// connectMQTT creates mqttClient from the config and starts connecting,
+// subscriptions are made by mqttOnConnectHandler on every connection
+func connectMQTT() mqtt.Token {
+	config := getConfig()
+	brokerAddr := fmt.Sprintf("tcp://%s:%d", config.MQTT.Host, config.MQTT.Port)
+
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(brokerAddr)
+	opts.SetClientID("FORTINO_BETA")
+	opts.SetUsername(config.MQTT.Username)
+	opts.SetPassword(config.MQTT.Password)
+	opts.SetKeepAlive(time.Duration(config.MQTT.KeepAlive) * time.Second)
+	opts.SetDefaultPublishHandler(mqttCallback)
+	opts.SetPingTimeout(30 * time.Second)
+	opts.SetConnectRetry(true)
+	opts.SetConnectRetryInterval(time.Minute)
+	opts.SetAutoReconnect(true)
+	opts.SetOnConnectHandler(mqttOnConnectHandler)
+	opts.SetWill(
+		fmt.Sprintf("tele/%s/LWT", config.MQTT.Topic),
+		"Offline", 0, true,
+	)
+
+	client := mqtt.NewClient(opts)
+	mqttClientMu.Lock()
+	mqttClient = client
+	mqttClientMu.Unlock()
+	return client.Connect()
+}
+
+// mqttConnected tells if the broker connection is up
+func mqttConnected() bool {
+	client := getMQTTClient()
+	return client != nil && client.IsConnectionOpen()
+}
+
+// disconnectMQTT sends the LWT offline message and disconnects
+func disconnectMQTT() {
+	client := getMQTTClient()
+	if client == nil {
+		return
+	}
+
+	token := client.Publish(
+		fmt.Sprintf("tele/%s/LWT", getConfig().MQTT.Topic),
+		0, true, "Offline",
+	)
+	published := token.WaitTimeout(time.Second)
+	if published {
+		log.Println("mqtt: LWT offline message sent")
+	} else {
+		log.Println("mqtt: failed to send LWT offline message")
+	}
+	client.Disconnect(500)
+}
+
 var mqttOnConnectHandler mqtt.OnConnectHandler = func(c mqtt.Client) {
+	config := getConfig()
+
 	log.Printf("mqtt: connected to %s", config.MQTT.Host)
+
+	cmndTopic := fmt.Sprintf("cmnd/%s/#", config.MQTT.Topic)
+	if token := c.Subscribe(cmndTopic, 0, nil); token.Wait() && token.Error() != nil {
+		log.Printf("mqtt: unable to subscribe to %s", cmndTopic)
+		log.Println(token.Error())
+	} else {
+		log.Printf("mqtt: subscribed to %s", cmndTopic)
+	}
+
+	log.Println("mqtt: sending LWT online message")
+	c.Publish(
+		fmt.Sprintf("tele/%s/LWT", config.MQTT.Topic),
+		0, true, "Online",
+	)
+
+	for _, z := range getZones() {
+		z.publishSetpoint()
+		z.publishMode()
+	}
+
+	for _, in := range config.DigitalInputs {
+		if state, ok := GetInputState(in.Name); ok {
+			PublishInputState(in.Name, state)
+		}
+	}
+
+	subscribeRuleTopics(c, true)
+	if len(config.Rules) > 0 {
+		PublishRulesState()
+	}
+
+	if config.HomeAssistant.Enabled {
+		PublishHADiscovery(c)
+	}
 }
 
 func main() {
 
-	logfileHandle, err := os.OpenFile("log/fortino.log", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
-	if err != nil {
-		log.Fatalf("error opening file: %v", err)
-	}
-	defer logfileHandle.Close()
-	wrt := io.MultiWriter(os.Stdout, logfileHandle)
-	log.SetOutput(wrt)
+	flag.Usage = usage
+	flag.Parse()
 
-	log.Println("starting fortino ...")
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(flag.Args()))
+	}
 
-	err = rpio.Open()
+	err := setLogLevel(*logLevelFlag)
 	if err != nil {
 		log.Fatalln(err)
 	}
-	defer rpio.Close()
+
+	if len(*logFlag) > 0 && *logFlag != "-" {
+		logfileHandle, err := os.OpenFile(*logFlag, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+		if err != nil {
+			log.Fatalf("error opening file: %v", err)
+		}
+		defer logfileHandle.Close()
+		wrt := io.MultiWriter(os.Stdout, logfileHandle)
+		log.SetOutput(wrt)
+	}
+
+	log.Printf("starting fortino %s ...", version)
 
 	// Interrupt signal callback
 	sysSignalChan := make(chan os.Signal, 2)
@@ -314,117 +718,125 @@ func main() {
 	go func() {
 		<-sysSignalChan // Wait for exit signal
 		log.Println("exit signal detected")
-		if mqttClient != nil {
-			token := mqttClient.Publish(
-				fmt.Sprintf("tele/%s/LWT", config.MQTT.Topic),
-				0, true, "Offline",
-			)
-			published := token.WaitTimeout(time.Second)
-			if published {
-				log.Println("mqtt: LWT offline message sent")
-			} else {
-				log.Println("mqtt: failed to send LWT offline message")
-			}
-			mqttClient.Disconnect(500)
-		}
+		disconnectMQTT()
 		os.Exit(1)
 	}()
 
 	// Config file reading
-	configFile, err := os.Open(CONFIG_FILE_PATH)
+	newConfig, errs := ValidateConfigFile(*configFlag)
+	if len(errs) > 0 {
+		for _, err := range errs {
+			log.Println(err)
+		}
+		log.Fatalf("%s: %d configuration errors", *configFlag, len(errs))
+	}
+	applyFlags(&newConfig)
+	if newConfig.UpdateInterval < 3 {
+		newConfig.UpdateInterval = 3
+	}
+	setConfig(newConfig)
+	config := getConfig()
+	log.Println("configuration read")
+
+	// Reload signal callback
+	reloadSignalChan := make(chan os.Signal, 1)
+	signal.Notify(reloadSignalChan, syscall.SIGHUP)
+	go func() {
+		for range reloadSignalChan {
+			log.Println("reload signal detected")
+			ReloadConfig(*configFlag)
+		}
+	}()
+
+	gpio, err = NewGPIODriver(config.GPIO)
 	if err != nil {
 		log.Fatalln(err)
 	}
-	defer configFile.Close()
-
-	byteValue, err := ioutil.ReadAll(configFile)
+	err = gpio.Open()
 	if err != nil {
 		log.Fatalln(err)
 	}
+	defer gpio.Close()
 
-	err = json.Unmarshal(byteValue, &config)
+	zones := []*ThermostatZone{}
+	for _, t := range ThermostatConfigs(config) {
+		zones = append(zones, NewThermostatZone(t))
+	}
+	setZones(zones)
+
+	savedState, err := LoadState()
 	if err != nil {
-		log.Fatalln(err)
+		log.Printf("state: ignoring %s: %v", config.StateFile, err)
 	}
-	log.Println("configuration read")
 
 	// SMS gateway goroutine
 	if config.HiLinkConfig.Enable {
-		go HiLinkRoutine(config.HiLinkConfig.Address)
+		startHiLinkRoutine()
 	}
 
 	// Initialize all outputs to the default values
 	io_init := ""
+	members := groupMembers(config)
 	for _, v := range config.DigitalOutputs {
-
-		pin := rpio.Pin(v.PIN)
-		pin.Output()
-
-		if (v.State && !v.InvertedLogic) || (!v.State && v.InvertedLogic) {
-			pin.High()
-			io_init = io_init + fmt.Sprintf(" pin %d OUT [HIGH]", v.PIN)
-		} else {
-			pin.Low()
-			io_init = io_init + fmt.Sprintf(" pin %d OUT [LOW]", v.PIN)
+		if _, grouped := members[v.Name]; grouped {
+			continue
 		}
+		if saved, ok := savedState.Outputs[v.Name]; ok && v.RestoreState {
+			v.State = saved != 0
+		}
+		io_init = io_init + initOutput(v)
+	}
+	for _, g := range config.OutputGroups {
+		if saved, ok := savedState.Outputs[g.Name]; ok && g.RestoreState {
+			g.State = saved != 0
+		}
+		io_init = io_init + initGroup(g)
 	}
 	log.Println("digital I/O init:" + io_init)
 
-	mqtt.ERROR = log.New(os.Stdout, "", 0)
-
-	brokerAddr := fmt.Sprintf("tcp://%s:%d", config.MQTT.Host, config.MQTT.Port)
+	for _, z := range getZones() {
+		z.Restore(savedState.Thermostats[z.Name()])
+	}
+	SaveState()
 
-	opts := mqtt.NewClientOptions()
-	opts.AddBroker(brokerAddr)
-	opts.SetClientID("FORTINO_BETA")
-	opts.SetUsername(config.MQTT.Username)
-	opts.SetPassword(config.MQTT.Password)
-	opts.SetKeepAlive(time.Duration(config.MQTT.KeepAlive) * time.Second)
-	opts.SetDefaultPublishHandler(mqttCallback)
-	opts.SetPingTimeout(30 * time.Second)
-	opts.SetConnectRetry(true)
-	opts.SetConnectRetryInterval(time.Minute)
-	opts.SetAutoReconnect(true)
-	opts.SetOnConnectHandler(mqttOnConnectHandler)
-	opts.SetWill(
-		fmt.Sprintf("tele/%s/LWT", config.MQTT.Topic),
-		"Offline", 0, true,
-	)
+	mqtt.ERROR = log.New(os.Stdout, "", 0)
 
 	log.Println("mqtt: trying to connect to broker")
-	mqttClient = mqtt.NewClient(opts)
-	token := mqttClient.Connect()
+	token := connectMQTT()
 	if token.Wait() && token.Error() != nil {
 		log.Fatalln(token.Error())
 	}
 
-	cmndTopic := fmt.Sprintf("cmnd/%s/+", config.MQTT.Topic)
-	if token := mqttClient.Subscribe(cmndTopic, 0, nil); token.Wait() && token.Error() != nil {
-		log.Fatalln(token.Error())
-	}
-	log.Printf("mqtt: subscribed to %s", cmndTopic)
-
-	log.Println("mqtt: sending LWT online message")
-	mqttClient.Publish(
-		fmt.Sprintf("tele/%s/LWT", config.MQTT.Topic),
-		0, true, "Online",
-	)
-
 	// Send output states after mqtt connection
 
 	// Sensor update go routine
-	if config.UpdateInterval < 3 {
-		config.UpdateInterval = 3
-	}
 	log.Printf("starting sampling loop every %d seconds", config.UpdateInterval)
 	go SensorSamplingRoutine(config.UpdateInterval)
 
-	// Thermostat go routine
-	if config.Thermostat.Runtime < 10 {
-		config.Thermostat.Runtime = 10
+	go ProtectionRoutine()
+	go SensorAlarmRoutine()
+
+	if len(config.DigitalInputs) > 0 {
+		startInputRoutine()
+	}
+	if len(config.Rules) > 0 {
+		startRulesRoutine()
+	}
+
+	// REST API go routine
+	if config.HTTP.Enabled {
+		go HTTPRoutine(config.HTTP)
+	}
+
+	// Thermostat go routines, one for each zone
+	for _, z := range getZones() {
+		z.Start()
+	}
+	go ThermostatTelemetryRoutine(config.UpdateInterval)
+
+	if config.WatchConfig {
+		startConfigWatchRoutine(*configFlag)
 	}
-	log.Printf("thermostat: starting with runtime %d seconds", config.Thermostat.Runtime)
-	go ThermostatRoutine()
 
 	time.Sleep(time.Hour * 24 * 5)
 }
@@ -0,0 +1,42 @@
+package main
+
+import "testing"
+
+// useConfig makes c the running config until the test ends
+func useConfig(t *testing.T, c FortinoConfig) {
+	t.Helper()
+	old := getConfig()
+	setConfig(c)
+	t.Cleanup(func() { setConfig(*old) })
+}
+
+func TestParsePowerPayload(t *testing.T) {
+	tests := []struct {
+		payload string
+		current int
+		want    int
+		wantErr bool
+	}{
+		{"ON", 0, 1, false},
+		{" on ", 0, 1, false},
+		{"1", 0, 1, false},
+		{"true", 0, 1, false},
+		{"OFF", 1, 0, false},
+		{"0", 1, 0, false},
+		{"False", 1, 0, false},
+		{"TOGGLE", 0, 1, false},
+		{"toggle", 1, 0, false},
+		{"", 1, 1, true},
+		{"2", 0, 0, true},
+		{"maybe", 1, 1, true},
+	}
+	for _, tt := range tests {
+		got, err := parsePowerPayload(tt.payload, tt.current)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parsePowerPayload(%q, %d) error = %v, want error %v", tt.payload, tt.current, err, tt.wantErr)
+		}
+		if got != tt.want {
+			t.Errorf("parsePowerPayload(%q, %d) = %d, want %d", tt.payload, tt.current, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/stianeikeland/go-rpio/v4"
+)
+
+// GPIODriver hides the hardware used to drive the digital outputs and
+// read the inputs, so fortino can run off target with the simulated
+// driver.
+type GPIODriver interface {
+	Open() error
+	Close() error
+	SetOutput(pin byte)
+	// pull is up, down or none
+	SetInput(pin byte, pull string)
+	Write(pin byte, high bool)
+	Read(pin byte) bool
+}
+
+var gpio GPIODriver
+
+func NewGPIODriver(name string) (GPIODriver, error) {
+	switch name {
+	case "", "rpio":
+		return &rpioDriver{}, nil
+	case "sim", "simulated":
+		return &simDriver{pins: map[byte]bool{}}, nil
+	}
+	return nil, fmt.Errorf("gpio: unknown driver '%s'", name)
+}
+
+// Raspberry Pi GPIO through /dev/gpiomem
+type rpioDriver struct{}
+
+func (d *rpioDriver) Open() error {
+	return rpio.Open()
+}
+
+func (d *rpioDriver) Close() error {
+	return rpio.Close()
+}
+
+func (d *rpioDriver) SetOutput(pin byte) {
+	rpio.Pin(pin).Output()
+}
+
+func (d *rpioDriver) SetInput(pin byte, pull string) {
+	rpio.Pin(pin).Input()
+	switch pull {
+	case "up":
+		rpio.Pin(pin).PullUp()
+	case "down":
+		rpio.Pin(pin).PullDown()
+	default:
+		rpio.Pin(pin).PullOff()
+	}
+}
+
+func (d *rpioDriver) Write(pin byte, high bool) {
+	if high {
+		rpio.Pin(pin).High()
+	} else {
+		rpio.Pin(pin).Low()
+	}
+}
+
+func (d *rpioDriver) Read(pin byte) bool {
+	return rpio.Pin(pin).Read() == rpio.High
+}
+
+// In memory pins, writes are only logged
+type simDriver struct {
+	mu   sync.Mutex
+	pins map[byte]bool
+}
+
+func (d *simDriver) Open() error {
+	log.Println("gpio: using simulated driver, no hardware will be touched")
+	return nil
+}
+
+func (d *simDriver) Close() error {
+	return nil
+}
+
+func (d *simDriver) SetOutput(pin byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.pins[pin]; !ok {
+		d.pins[pin] = false
+	}
+}
+
+// SetInput leaves the pin at its pull level, a Write changes it
+func (d *simDriver) SetInput(pin byte, pull string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.pins[pin]; !ok {
+		d.pins[pin] = pull == "up"
+	}
+}
+
+func (d *simDriver) Write(pin byte, high bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.pins[pin] = high
+	log.Printf("gpio: [sim] pin %d -> %s", pin, levelName(high))
+}
+
+func (d *simDriver) Read(pin byte) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.pins[pin]
+}
+
+func levelName(high bool) string {
+	if high {
+		return "HIGH"
+	}
+	return "LOW"
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// OutputGroupConfig drives several outputs as a single one, es. the two
+// poles of a relay or an H-bridge. Members are switched on in order and
+// off in reverse order, DelayMs apart, and are no longer addressable on
+// their own.
+type OutputGroupConfig struct {
+	Name    string   `json:"name"`
+	Members []string `json:"members"`
+	DelayMs uint     `json:"delay_ms"`
+	// outputs or groups that must be off for the group to switch on
+	Interlock    []string         `json:"interlock"`
+	State        bool             `json:"initial"`
+	RestoreState bool             `json:"restore_state"`
+	Protection   ProtectionConfig `json:"protection"`
+}
+
+func findOutputGroup(c *FortinoConfig, name string) (OutputGroupConfig, bool) {
+	for _, g := range c.OutputGroups {
+		if g.Name == name {
+			return g, true
+		}
+	}
+	return OutputGroupConfig{}, false
+}
+
+// groupMembers maps each grouped output to its group
+func groupMembers(c *FortinoConfig) map[string]string {
+	members := map[string]string{}
+	for _, g := range c.OutputGroups {
+		for _, m := range g.Members {
+			members[m] = g.Name
+		}
+	}
+	return members
+}
+
+// outputNames lists what can be switched by name: the outputs not in a
+// group, then the groups
+func outputNames(c *FortinoConfig) []string {
+	names := []string{}
+	seen := map[string]bool{}
+	members := groupMembers(c)
+	for _, o := range c.DigitalOutputs {
+		if _, grouped := members[o.Name]; grouped || seen[o.Name] {
+			continue
+		}
+		seen[o.Name] = true
+		names = append(names, o.Name)
+	}
+	for _, g := range c.OutputGroups {
+		names = append(names, g.Name)
+	}
+	return names
+}
+
+// driveGroup switches the members in order, then checks the feedback of
+// all of them
+func driveGroup(g OutputGroupConfig, state int) error {
+	members := []DigitalOutputConfig{}
+	for _, name := range g.Members {
+		for _, o := range getConfig().DigitalOutputs {
+			if o.Name == name {
+				members = append(members, o)
+			}
+		}
+	}
+	if state == 0 {
+		for i, j := 0, len(members)-1; i < j; i, j = i+1, j-1 {
+			members[i], members[j] = members[j], members[i]
+		}
+	}
+
+	for i, o := range members {
+		if i > 0 && g.DelayMs > 0 {
+			time.Sleep(time.Millisecond * time.Duration(g.DelayMs))
+		}
+		gpio.Write(o.PIN, outputPinLevel(o, state))
+		debugf("group %s: output %s %s", g.Name, o.Name, levelName(outputPinLevel(o, state)))
+	}
+
+	time.Sleep(time.Second)
+	for _, o := range members {
+		if pinState := gpio.Read(o.PIN); pinState != outputPinLevel(o, state) {
+			return fmt.Errorf("group %s: pin %d of %s set to %s but feedback is %s", g.Name, o.PIN, o.Name, levelName(outputPinLevel(o, state)), levelName(pinState))
+		}
+	}
+	return nil
+}
+
+// initGroup configures the member pins and drives the group to its
+// initial state, returning the log line fragment
+func initGroup(g OutputGroupConfig) string {
+	unlock := lockOutputs(g.Name)
+	defer unlock()
+
+	for _, name := range g.Members {
+		for _, o := range getConfig().DigitalOutputs {
+			if o.Name == name {
+				gpio.SetOutput(o.PIN)
+			}
+		}
+	}
+
+	state := 0
+	if g.State {
+		state = 1
+	}
+	err := driveGroup(g, state)
+	if err != nil {
+		log.Println(err)
+	}
+	PublishGroupFeedback(g.Name, err == nil)
+
+	outputStatesMu.Lock()
+	outputStates[g.Name] = state
+	outputStatesMu.Unlock()
+	recordSwitch(g.Name, state, time.Now().UTC())
+
+	return fmt.Sprintf(" group %s %v [%d]", g.Name, g.Members, state)
+}
+
+// PublishGroupFeedback publishes "OK" on stat/<topic>/<group>/FEEDBACK
+// when every member pin reads back as driven, "FAULT" otherwise
+func PublishGroupFeedback(groupName string, ok bool) {
+	client := getMQTTClient()
+	if client == nil {
+		return
+	}
+
+	payload := "OK"
+	if !ok {
+		payload = "FAULT"
+	}
+	client.Publish(fmt.Sprintf("stat/%s/%s/FEEDBACK", getConfig().MQTT.Topic, groupName), 0, true, payload)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+type HomeAssistantConfig struct {
+	Enabled         bool   `json:"enabled"`
+	DiscoveryPrefix string `json:"discovery_prefix"`
+}
+
+// discovery topics published in this session, everything else found
+// retained under our node id is stale and gets removed
+var haPublished = map[string]bool{}
+var haPublishedMu sync.Mutex
+
+var haInvalidIDChars = regexp.MustCompile(`[^a-z0-9_-]+`)
+
+func haObjectID(name string) string {
+	return haInvalidIDChars.ReplaceAllString(strings.ToLower(name), "_")
+}
+
+func haDiscoveryPrefix() string {
+	config := getConfig()
+
+	if len(config.HomeAssistant.DiscoveryPrefix) == 0 {
+		return "homeassistant"
+	}
+	return config.HomeAssistant.DiscoveryPrefix
+}
+
+func haNodeID() string {
+	return "fortino_" + haObjectID(getConfig().MQTT.Topic)
+}
+
+func haDiscoveryTopic(component string, objectID string) string {
+	return fmt.Sprintf("%s/%s/%s/%s/config", haDiscoveryPrefix(), component, haNodeID(), objectID)
+}
+
+// haEntities builds the discovery payloads for the current config, keyed
+// by discovery topic
+func haEntities() map[string]map[string]interface{} {
+	config := getConfig()
+
+	topic := config.MQTT.Topic
+	nodeID := haNodeID()
+
+	device := map[string]interface{}{
+		"identifiers":  []string{nodeID},
+		"name":         fmt.Sprintf("fortino %s", topic),
+		"manufacturer": "fortino",
+		"model":        "Raspberry Pi",
+	}
+	common := func(name string, objectID string) map[string]interface{} {
+		return map[string]interface{}{
+			"name":                  name,
+			"unique_id":             nodeID + "_" + objectID,
+			"availability_topic":    fmt.Sprintf("tele/%s/LWT", topic),
+			"payload_available":     "Online",
+			"payload_not_available": "Offline",
+			"device":                device,
+		}
+	}
+
+	entities := map[string]map[string]interface{}{}
+
+	// Groups are a single switch, their members have none
+	for _, name := range outputNames(config) {
+		objectID := haObjectID(name)
+		e := common(name, objectID)
+		e["command_topic"] = fmt.Sprintf("cmnd/%s/%s", topic, name)
+		e["state_topic"] = fmt.Sprintf("stat/%s/%s", topic, name)
+		e["payload_on"] = "ON"
+		e["payload_off"] = "OFF"
+		e["state_on"] = "true"
+		e["state_off"] = "false"
+		entities[haDiscoveryTopic("switch", objectID)] = e
+	}
+
+	for _, in := range config.DigitalInputs {
+		objectID := haObjectID(in.Name)
+		e := common(in.Name, objectID)
+		e["state_topic"] = fmt.Sprintf("stat/%s/%s", topic, inputTopicKey(config, in.Name))
+		e["payload_on"] = "ON"
+		e["payload_off"] = "OFF"
+		entities[haDiscoveryTopic("binary_sensor", objectID)] = e
+	}
+
+	sensorKeys := sensorTeleKeys()
+	temperatureSensor := func(name string, objectID string, key string) map[string]interface{} {
+		e := common(name, objectID)
+		e["state_topic"] = fmt.Sprintf("tele/%s/SENSOR", topic)
+		e["value_template"] = fmt.Sprintf("{{ value_json['%s'].Temperature }}", key)
+		e["unit_of_measurement"] = "°C"
+		e["device_class"] = "temperature"
+		e["state_class"] = "measurement"
+		return e
+	}
+	for _, s := range config.Onewires {
+		objectID := haObjectID(s.Name)
+		entities[haDiscoveryTopic("sensor", objectID)] = temperatureSensor(s.Name, objectID, sensorKeys[s.Name])
+	}
+	entities[haDiscoveryTopic("sensor", "rpi_cpu")] = temperatureSensor("RPi CPU", "rpi_cpu", "RPI")
+
+	for _, z := range getZones() {
+		cfg := z.Config()
+		objectID := haObjectID(cfg.Name)
+		e := common(cfg.Name, objectID)
+		e["temperature_command_topic"] = fmt.Sprintf("cmnd/%s/%s/TEMPTARGETSET", topic, cfg.Name)
+		e["temperature_state_topic"] = fmt.Sprintf("stat/%s/%s/TEMPTARGET", topic, cfg.Name)
+		e["action_topic"] = fmt.Sprintf("tele/%s/THERMOSTAT", topic)
+		e["action_template"] = fmt.Sprintf("{%% set z = value_json['%s'] %%}{{ 'heating' if z.Heater == 'ON' else 'cooling' if z.Cooler == 'ON' else 'idle' }}", cfg.Name)
+		e["modes"] = cfg.Modes()
+		e["mode_command_topic"] = fmt.Sprintf("cmnd/%s/%s/MODE", topic, cfg.Name)
+		e["mode_state_topic"] = fmt.Sprintf("stat/%s/%s/MODE", topic, cfg.Name)
+		e["mode_state_template"] = "{{ 'off' if value == 'manual' else value }}"
+		e["min_temp"], e["max_temp"], e["temp_step"] = cfg.SetpointRange()
+		e["temperature_unit"] = "C"
+		if cfg.Schedule.Enabled {
+			presets := []string{"auto"}
+			for preset := range cfg.Schedule.Presets {
+				presets = append(presets, preset)
+			}
+			sort.Strings(presets[1:])
+			e["preset_modes"] = presets
+			e["preset_mode_command_topic"] = fmt.Sprintf("cmnd/%s/%s/PRESET", topic, cfg.Name)
+		}
+		if key, ok := sensorKeys[cfg.FeedbackName]; ok {
+			e["current_temperature_topic"] = fmt.Sprintf("tele/%s/SENSOR", topic)
+			e["current_temperature_template"] = fmt.Sprintf("{{ value_json['%s'].Temperature }}", key)
+		}
+		entities[haDiscoveryTopic("climate", objectID)] = e
+	}
+
+	return entities
+}
+
+// PublishHADiscovery publishes the retained discovery payloads and
+// removes the ones left by entities no longer in the config.
+func PublishHADiscovery(c mqtt.Client) {
+
+	entities := haEntities()
+
+	haPublishedMu.Lock()
+	haPublished = map[string]bool{}
+	for discoveryTopic, e := range entities {
+		payload, err := json.Marshal(e)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		c.Publish(discoveryTopic, 0, true, payload)
+		haPublished[discoveryTopic] = true
+	}
+	haPublishedMu.Unlock()
+	log.Printf("homeassistant: published %d discovery configs", len(entities))
+
+	// Retained configs are delivered right after subscribing
+	staleFilter := fmt.Sprintf("%s/+/%s/+/config", haDiscoveryPrefix(), haNodeID())
+	token := c.Subscribe(staleFilter, 0, haStaleCallback)
+	if token.Wait() && token.Error() != nil {
+		log.Printf("homeassistant: unable to subscribe to %s", staleFilter)
+		log.Println(token.Error())
+	}
+}
+
+// RemoveHADiscovery clears the discovery configs published so far, used
+// before the node id changes or discovery is disabled
+func RemoveHADiscovery(c mqtt.Client) {
+	if c == nil || !c.IsConnected() {
+		return
+	}
+
+	haPublishedMu.Lock()
+	for discoveryTopic := range haPublished {
+		c.Publish(discoveryTopic, 0, true, "")
+	}
+	count := len(haPublished)
+	haPublished = map[string]bool{}
+	haPublishedMu.Unlock()
+
+	c.Unsubscribe(fmt.Sprintf("%s/+/%s/+/config", haDiscoveryPrefix(), haNodeID()))
+	log.Printf("homeassistant: removed %d discovery configs", count)
+}
+
+var haStaleCallback mqtt.MessageHandler = func(c mqtt.Client, msg mqtt.Message) {
+
+	if len(msg.Payload()) == 0 {
+		return
+	}
+
+	haPublishedMu.Lock()
+	current := haPublished[msg.Topic()]
+	haPublishedMu.Unlock()
+
+	if !current {
+		log.Printf("homeassistant: removing stale discovery config %s", msg.Topic())
+		c.Publish(msg.Topic(), 0, true, "")
+	}
+}
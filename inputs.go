@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"sync"
+	"time"
+)
+
+const inputPollInterval = 10 * time.Millisecond
+const defaultDebounceMs = 50
+
+// DigitalInputConfig is a button, contact or reed switch. The input is on
+// when the pin is high, or low with InvertedLogic (es. a button to ground
+// with the pull-up). Edges are published on stat/<topic>/SWITCHn, n is
+// the position in the config, or on stat/<topic>/<id>.
+type DigitalInputConfig struct {
+	Name          string
+	ID            string `json:"id"`
+	PIN           byte
+	Pull          string `json:"pull"` // up, down or none
+	InvertedLogic bool   `json:"inverted_logic"`
+	DebounceMs    uint   `json:"debounce_ms"`
+	// both, rising (switching on) or falling (switching off)
+	Edge string `json:"edge"`
+
+	// Local binding, works without MQTT: toggle switches the output on
+	// every edge, follow sets it to the input state and needs edge both
+	Output string `json:"output"`
+	Action string `json:"action"`
+}
+
+var inputPulls = []string{"", "up", "down", "none"}
+var inputEdges = []string{"", "both", "rising", "falling"}
+var inputActions = []string{"", "toggle", "follow"}
+
+// debounced state of each input, by input name
+var inputStates = map[string]bool{}
+var inputStatesMu sync.Mutex
+
+// InputEdgeHandler is called on every reported edge, after the local
+// binding
+type InputEdgeHandler func(in DigitalInputConfig, state bool)
+
+var inputEdgeHandlers []InputEdgeHandler
+
+func OnInputEdge(h InputEdgeHandler) {
+	inputEdgeHandlers = append(inputEdgeHandlers, h)
+}
+
+func GetInputState(inputName string) (bool, bool) {
+	inputStatesMu.Lock()
+	defer inputStatesMu.Unlock()
+	state, ok := inputStates[inputName]
+	return state, ok
+}
+
+// inputTopicKey is the last level of the input topic, es. SWITCH1
+func inputTopicKey(c *FortinoConfig, inputName string) string {
+	for i, in := range c.DigitalInputs {
+		if in.Name != inputName {
+			continue
+		}
+		if len(in.ID) > 0 {
+			return in.ID
+		}
+		return fmt.Sprintf("SWITCH%d", i+1)
+	}
+	return ""
+}
+
+// edgeReported tells if the input edge config lets the change through
+func edgeReported(in DigitalInputConfig, state bool) bool {
+	switch in.Edge {
+	case "rising":
+		return state
+	case "falling":
+		return !state
+	}
+	return true
+}
+
+func PublishInputState(inputName string, state bool) {
+	client := getMQTTClient()
+	config := getConfig()
+	if client == nil {
+		return
+	}
+
+	payload := "OFF"
+	if state {
+		payload = "ON"
+	}
+	client.Publish(fmt.Sprintf("stat/%s/%s", config.MQTT.Topic, inputTopicKey(config, inputName)), 0, false, payload)
+}
+
+var inputRoutineOnce sync.Once
+
+func startInputRoutine() {
+	inputRoutineOnce.Do(func() {
+		go InputRoutine()
+	})
+}
+
+// debouncing state of one input
+type inputPoll struct {
+	raw      bool
+	rawSince time.Time
+	stable   bool
+}
+
+// InputRoutine polls the inputs, a change is accepted once the pin has
+// been stable for debounce_ms. The pins are set up again when the inputs
+// config changes.
+func InputRoutine() {
+	var inputs []DigitalInputConfig
+	polls := map[string]*inputPoll{}
+
+	// Bindings drive outputs with a 1s feedback wait, they run in order
+	// apart from the polling
+	events := make(chan func(), 32)
+	go func() {
+		for event := range events {
+			event()
+		}
+	}()
+
+	for {
+		now := time.Now()
+
+		if configured := getConfig().DigitalInputs; !reflect.DeepEqual(inputs, configured) {
+			inputs = append([]DigitalInputConfig{}, configured...)
+			polls = setupInputs(inputs, now)
+		}
+
+		for _, in := range inputs {
+			p := polls[in.Name]
+			raw := gpio.Read(in.PIN) != in.InvertedLogic
+			if raw != p.raw {
+				p.raw = raw
+				p.rawSince = now
+			}
+			debounce := time.Duration(in.DebounceMs) * time.Millisecond
+			if in.DebounceMs == 0 {
+				debounce = defaultDebounceMs * time.Millisecond
+			}
+			if p.raw == p.stable || now.Sub(p.rawSince) < debounce {
+				continue
+			}
+			p.stable = p.raw
+
+			inputStatesMu.Lock()
+			inputStates[in.Name] = p.stable
+			inputStatesMu.Unlock()
+
+			if !edgeReported(in, p.stable) {
+				continue
+			}
+			debugf("input %s: pin %d %s", in.Name, in.PIN, levelName(gpio.Read(in.PIN)))
+			PublishInputState(in.Name, p.stable)
+
+			in, state := in, p.stable
+			select {
+			case events <- func() { inputEdge(in, state) }:
+			default:
+				log.Printf("input %s: too many pending edges, dropped", in.Name)
+			}
+		}
+
+		time.Sleep(inputPollInterval)
+	}
+}
+
+// setupInputs configures the input pins and takes their current state,
+// without reporting it as an edge
+func setupInputs(inputs []DigitalInputConfig, now time.Time) map[string]*inputPoll {
+	polls := map[string]*inputPoll{}
+	states := map[string]bool{}
+	io_init := ""
+	for _, in := range inputs {
+		gpio.SetInput(in.PIN, in.Pull)
+		state := gpio.Read(in.PIN) != in.InvertedLogic
+		polls[in.Name] = &inputPoll{raw: state, rawSince: now, stable: state}
+		states[in.Name] = state
+		io_init = io_init + fmt.Sprintf(" pin %d IN [%s]", in.PIN, levelName(gpio.Read(in.PIN)))
+	}
+
+	inputStatesMu.Lock()
+	inputStates = states
+	inputStatesMu.Unlock()
+
+	if len(io_init) > 0 {
+		log.Println("digital input init:" + io_init)
+	}
+	return polls
+}
+
+// inputEdge applies the local binding, then the edge handlers
+func inputEdge(in DigitalInputConfig, state bool) {
+	if len(in.Output) > 0 {
+		payload := "toggle"
+		if in.Action == "follow" {
+			payload = "off"
+			if state {
+				payload = "on"
+			}
+		}
+		// follow leaves an output already in the input state alone
+		current, _ := GetOutputState(in.Output)
+		if next, _ := parsePowerPayload(payload, current); next != current {
+			log.Printf("input %s: switching %s %s", in.Name, in.Output, payload)
+			_, err := SetOutputPower(in.Output, payload)
+			if err != nil {
+				log.Println(err)
+			}
+		}
+	}
+
+	for _, h := range inputEdgeHandlers {
+		h(in, state)
+	}
+}
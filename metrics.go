@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// read errors by sensor ID, incremented by the sensor drivers
+var sensorReadErrors = map[string]uint64{}
+var sensorReadErrorsMu sync.Mutex
+
+func countSensorReadError(ID string) {
+	sensorReadErrorsMu.Lock()
+	sensorReadErrors[ID] = sensorReadErrors[ID] + 1
+	sensorReadErrorsMu.Unlock()
+}
+
+// promWriter writes the Prometheus text exposition format
+type promWriter struct {
+	w *bufio.Writer
+}
+
+func (p promWriter) header(name string, help string, kind string) {
+	fmt.Fprintf(p.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sample writes a value, labels are name/value pairs
+func (p promWriter) sample(name string, value float64, labels ...string) {
+	p.w.WriteString(name)
+	if len(labels) > 0 {
+		pairs := []string{}
+		for i := 0; i+1 < len(labels); i += 2 {
+			pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", labels[i], promEscape(labels[i+1])))
+		}
+		p.w.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+	p.w.WriteString(" " + strconv.FormatFloat(value, 'g', -1, 64) + "\n")
+}
+
+var promEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func promEscape(s string) string {
+	return promEscaper.Replace(s)
+}
+
+func promBool(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	config := getConfig()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	p := promWriter{w: bufio.NewWriter(w)}
+	defer p.w.Flush()
+
+	samples := LatestSamples()
+	sort.Slice(samples, func(i, j int) bool { return samples[i].Name < samples[j].Name })
+
+	sensorIDs := map[string]string{}
+	for _, s := range config.Onewires {
+		sensorIDs[s.Name] = s.ID
+	}
+
+	p.header("fortino_sensor_temperature_celsius", "Last temperature read from the sensor.", "gauge")
+	for _, s := range samples {
+		// A failed read has no temperature, fortino_sensor_up tells it
+		if s.Type == "cpu" || s.Status != "ok" {
+			continue
+		}
+		p.sample("fortino_sensor_temperature_celsius", s.fValue, "sensor", s.Name, "type", s.Type, "id", sensorIDs[s.Name])
+	}
+	p.header("fortino_sensor_up", "Whether the last read of the sensor succeeded.", "gauge")
+	for _, s := range samples {
+		if s.Type == "cpu" {
+			continue
+		}
+		p.sample("fortino_sensor_up", promBool(s.Status == "ok"), "sensor", s.Name)
+	}
+	for _, s := range samples {
+		if s.Type == "cpu" {
+			p.header("fortino_rpi_cpu_temperature_celsius", "Raspberry Pi CPU temperature.", "gauge")
+			p.sample("fortino_rpi_cpu_temperature_celsius", s.fValue)
+		}
+	}
+
+	sensorReadErrorsMu.Lock()
+	ids := make([]string, 0, len(sensorReadErrors))
+	for ID := range sensorReadErrors {
+		ids = append(ids, ID)
+	}
+	sort.Strings(ids)
+	p.header("fortino_sensor_read_errors_total", "Failed sensor reads.", "counter")
+	for _, ID := range ids {
+		p.sample("fortino_sensor_read_errors_total", float64(sensorReadErrors[ID]), "id", ID)
+	}
+	sensorReadErrorsMu.Unlock()
+
+	p.header("fortino_output_state", "Output state, 1 is on.", "gauge")
+	for _, name := range outputNames(config) {
+		state, _ := GetOutputState(name)
+		p.sample("fortino_output_state", float64(state), "output", name)
+	}
+
+	p.header("fortino_input_state", "Debounced input state, 1 is on.", "gauge")
+	for _, in := range config.DigitalInputs {
+		if state, ok := GetInputState(in.Name); ok {
+			p.sample("fortino_input_state", promBool(state), "input", in.Name)
+		}
+	}
+
+	zones := getZones()
+	p.header("fortino_thermostat_enabled", "Whether the thermostat is enabled.", "gauge")
+	for _, z := range zones {
+		p.sample("fortino_thermostat_enabled", promBool(z.Config().Enabled), "zone", z.Name())
+	}
+	p.header("fortino_thermostat_setpoint_celsius", "Thermostat setpoint.", "gauge")
+	for _, z := range zones {
+		p.sample("fortino_thermostat_setpoint_celsius", z.Config().Setpoint, "zone", z.Name())
+	}
+	p.header("fortino_thermostat_feedback_celsius", "Temperature measured by the thermostat feedback sensor.", "gauge")
+	for _, z := range zones {
+		if status := z.Status(); !status.SampledAt.IsZero() {
+			p.sample("fortino_thermostat_feedback_celsius", status.MeasuredTemp, "zone", z.Name())
+		}
+	}
+	p.header("fortino_thermostat_error_celsius", "Setpoint minus measured temperature.", "gauge")
+	for _, z := range zones {
+		if status := z.Status(); !status.SampledAt.IsZero() {
+			p.sample("fortino_thermostat_error_celsius", status.TempErr, "zone", z.Name())
+		}
+	}
+	p.header("fortino_thermostat_demand_ratio", "Regulator output, 0 is off and 1 fully on.", "gauge")
+	for _, z := range zones {
+		if status := z.Status(); !status.SampledAt.IsZero() {
+			p.sample("fortino_thermostat_demand_ratio", status.Demand, "zone", z.Name())
+		}
+	}
+	p.header("fortino_thermostat_failsafe", "Whether the thermostat lost its feedback and runs in failsafe.", "gauge")
+	for _, z := range zones {
+		p.sample("fortino_thermostat_failsafe", promBool(z.Status().Failsafe), "zone", z.Name())
+	}
+	p.header("fortino_thermostat_heater_on", "Whether the thermostat is driving the actuator on.", "gauge")
+	for _, z := range zones {
+		p.sample("fortino_thermostat_heater_on", promBool(z.Status().HeaterOn), "zone", z.Name())
+	}
+	p.header("fortino_thermostat_cooler_on", "Whether the thermostat is driving the cooling actuator on.", "gauge")
+	for _, z := range zones {
+		p.sample("fortino_thermostat_cooler_on", promBool(z.Status().CoolerOn), "zone", z.Name())
+	}
+
+	p.header("fortino_mqtt_connected", "Whether the MQTT broker connection is up.", "gauge")
+	p.sample("fortino_mqtt_connected", promBool(mqttConnected()))
+
+	if config.HiLinkConfig.Enable {
+		hiLinkUp, hiLinkLastOK := GetHiLinkStatus()
+		p.header("fortino_hilink_up", "Whether the last HiLink SMS gateway poll succeeded.", "gauge")
+		p.sample("fortino_hilink_up", promBool(hiLinkUp))
+		if !hiLinkLastOK.IsZero() {
+			p.header("fortino_hilink_last_success_timestamp_seconds", "Time of the last successful HiLink poll.", "gauge")
+			p.sample("fortino_hilink_last_success_timestamp_seconds", float64(hiLinkLastOK.Unix()))
+		}
+
+		smsByStatus := map[string]int{}
+		for _, m := range SMSQueueStatus() {
+			smsByStatus[m.Status]++
+		}
+		p.header("fortino_sms_messages", "Outbound SMS in the queue and in the recent history, by status.", "gauge")
+		for _, status := range []string{SMSQueued, SMSSent, SMSFailed} {
+			p.sample("fortino_sms_messages", float64(smsByStatus[status]), "status", status)
+		}
+	}
+
+	p.header("fortino_uptime_seconds", "Seconds since fortino started.", "gauge")
+	p.sample("fortino_uptime_seconds", time.Since(startedAt).Seconds())
+}
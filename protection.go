@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// ProtectionConfig limits how often an output can be switched, to spare
+// compressors, boilers and relays. Times are in seconds, zero disables
+// the rule. MaxSwitchesPerHour counts the switch ons. An output on for
+// longer than MaxOn is forced off and kept off until an explicit command.
+type ProtectionConfig struct {
+	MinOn              uint `json:"min_on"`
+	MinOff             uint `json:"min_off"`
+	MaxSwitchesPerHour uint `json:"max_switches_per_hour"`
+	MaxOn              uint `json:"max_on"`
+}
+
+func (p ProtectionConfig) enabled() bool {
+	return p.MinOn > 0 || p.MinOff > 0 || p.MaxSwitchesPerHour > 0 || p.MaxOn > 0
+}
+
+// ProtectionError is returned by SetOutputState when a protection rule
+// refuses the switch
+type ProtectionError struct {
+	Output    string
+	State     int
+	Rule      string
+	Wait      time.Duration
+	Interlock string
+}
+
+func (e *ProtectionError) Error() string {
+	if len(e.Interlock) > 0 {
+		return fmt.Sprintf("output %s: %s with %s refuses switching to %d", e.Output, e.Rule, e.Interlock, e.State)
+	} else if e.Wait > 0 {
+		return fmt.Sprintf("output %s: %s refuses switching to %d for %s", e.Output, e.Rule, e.State, e.Wait.Round(time.Second))
+	}
+	return fmt.Sprintf("output %s: %s refuses switching to %d", e.Output, e.Rule, e.State)
+}
+
+// switching history of each output, by output name
+type outputHistory struct {
+	changedAt time.Time
+	starts    []time.Time
+	// last refused switch, reported once until something changes
+	refused string
+	// forced off by max_on, it stays off until an explicit command
+	latched bool
+}
+
+var outputHistories = map[string]*outputHistory{}
+var outputHistoriesMu sync.Mutex
+
+// outputProtection returns the protection of the group or of the first
+// config entry with the output name that has one
+func outputProtection(outputName string) ProtectionConfig {
+	config := getConfig()
+
+	if g, isGroup := findOutputGroup(config, outputName); isGroup {
+		return g.Protection
+	}
+	for _, o := range config.DigitalOutputs {
+		if o.Name == outputName && o.Protection.enabled() {
+			return o.Protection
+		}
+	}
+	return ProtectionConfig{}
+}
+
+// checkProtection tells if the output can go from current to state now,
+// switching to the same state is not a switch and is always allowed
+func checkProtection(outputName string, current int, state int, now time.Time) error {
+	if current == state {
+		return nil
+	}
+	p := outputProtection(outputName)
+	interlock := ""
+	if state != 0 {
+		interlock = interlockingOutput(outputName)
+	}
+	if !p.enabled() && len(interlock) == 0 {
+		return nil
+	}
+
+	outputHistoriesMu.Lock()
+	defer outputHistoriesMu.Unlock()
+
+	h, ok := outputHistories[outputName]
+	if !ok {
+		h = &outputHistory{}
+		outputHistories[outputName] = h
+	}
+
+	// Without a known last switch the times can't be checked
+	elapsed := now.Sub(h.changedAt)
+	known := !h.changedAt.IsZero()
+	var perr *ProtectionError
+	if len(interlock) > 0 {
+		perr = &ProtectionError{Output: outputName, State: state, Rule: "interlock", Interlock: interlock}
+	} else if state != 0 && h.latched {
+		perr = &ProtectionError{Output: outputName, State: state, Rule: "max_on"}
+	} else if known && state == 0 && p.MinOn > 0 && elapsed < time.Duration(p.MinOn)*time.Second {
+		perr = &ProtectionError{Output: outputName, State: state, Rule: "min_on", Wait: time.Duration(p.MinOn)*time.Second - elapsed}
+	} else if known && state != 0 && p.MinOff > 0 && elapsed < time.Duration(p.MinOff)*time.Second {
+		perr = &ProtectionError{Output: outputName, State: state, Rule: "min_off", Wait: time.Duration(p.MinOff)*time.Second - elapsed}
+	} else if state != 0 && p.MaxSwitchesPerHour > 0 {
+		h.starts = startsWithin(h.starts, now, time.Hour)
+		if uint(len(h.starts)) >= p.MaxSwitchesPerHour {
+			perr = &ProtectionError{Output: outputName, State: state, Rule: "max_switches_per_hour", Wait: h.starts[0].Add(time.Hour).Sub(now)}
+		}
+	}
+	if perr == nil {
+		return nil
+	}
+
+	// Callers like the thermostat retry every second, report only news
+	if key := fmt.Sprintf("%s/%d", perr.Rule, state); h.refused != key {
+		h.refused = key
+		reportProtection(outputName, state, perr.Rule, perr.Error())
+	}
+	return perr
+}
+
+// interlockingOutput returns an output or group that is on and keeps the
+// group from switching on
+func interlockingOutput(outputName string) string {
+	g, isGroup := findOutputGroup(getConfig(), outputName)
+	if !isGroup {
+		return ""
+	}
+	for _, other := range g.Interlock {
+		if state, _ := GetOutputState(other); state != 0 {
+			return other
+		}
+	}
+	return ""
+}
+
+// recordSwitch updates the history after the output changed state
+func recordSwitch(outputName string, state int, now time.Time) {
+	outputHistoriesMu.Lock()
+	defer outputHistoriesMu.Unlock()
+
+	h, ok := outputHistories[outputName]
+	if !ok {
+		h = &outputHistory{}
+		outputHistories[outputName] = h
+	}
+	h.changedAt = now
+	h.refused = ""
+	if state != 0 {
+		h.starts = append(startsWithin(h.starts, now, time.Hour), now)
+	}
+}
+
+// releaseMaxOnLatch lets an output forced off by max_on switch on again
+func releaseMaxOnLatch(outputName string) {
+	outputHistoriesMu.Lock()
+	defer outputHistoriesMu.Unlock()
+
+	if h, ok := outputHistories[outputName]; ok {
+		h.latched = false
+	}
+}
+
+func startsWithin(starts []time.Time, now time.Time, window time.Duration) []time.Time {
+	kept := starts[:0]
+	for _, t := range starts {
+		if now.Sub(t) < window {
+			kept = append(kept, t)
+		}
+	}
+	return kept
+}
+
+// reportProtection logs a protection intervention and publishes it on
+// tele/<topic>/PROTECTION
+func reportProtection(outputName string, state int, rule string, message string) {
+	log.Printf("protection: %s", message)
+
+	client := getMQTTClient()
+	if client == nil {
+		return
+	}
+	jsonStr, err := json.Marshal(map[string]interface{}{
+		"Time":    time.Now().UTC().Format(MQTT_DATETIME_FORMAT),
+		"Output":  outputName,
+		"State":   state,
+		"Rule":    rule,
+		"Message": message,
+	})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	client.Publish(fmt.Sprintf("tele/%s/PROTECTION", getConfig().MQTT.Topic), 0, false, jsonStr)
+}
+
+// ProtectionRoutine switches off the outputs on for longer than their
+// max_on and keeps them off until an explicit command
+func ProtectionRoutine() {
+	for {
+		now := time.Now().UTC()
+
+		for _, name := range outputNames(getConfig()) {
+			p := outputProtection(name)
+			if p.MaxOn == 0 {
+				continue
+			}
+			state, _ := GetOutputState(name)
+			if state == 0 {
+				continue
+			}
+
+			outputHistoriesMu.Lock()
+			var changedAt time.Time
+			if h, ok := outputHistories[name]; ok {
+				changedAt = h.changedAt
+			}
+			outputHistoriesMu.Unlock()
+
+			maxOn := time.Duration(p.MaxOn) * time.Second
+			if changedAt.IsZero() || now.Sub(changedAt) < maxOn {
+				continue
+			}
+
+			reportProtection(name, 0, "max_on", fmt.Sprintf("output %s: on for more than %s, forced off until switched on by a command", name, maxOn))
+			// Latched under the output lock, so nothing switches it on between
+			unlock := lockOutput(name)
+			err := switchOutput(name, 0, true)
+			if err == nil {
+				outputHistoriesMu.Lock()
+				if h, ok := outputHistories[name]; ok {
+					h.latched = true
+				}
+				outputHistoriesMu.Unlock()
+			}
+			unlock()
+			if err != nil {
+				log.Println(err)
+			}
+		}
+
+		time.Sleep(time.Second)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckProtection(t *testing.T) {
+	useConfig(t, FortinoConfig{
+		DigitalOutputs: []DigitalOutputConfig{
+			{Name: "boiler", PIN: 5, Protection: ProtectionConfig{MinOn: 60, MinOff: 120, MaxSwitchesPerHour: 2}},
+			{Name: "light", PIN: 6},
+			{Name: "valve1", PIN: 7},
+			{Name: "valve2", PIN: 8},
+		},
+		OutputGroups: []OutputGroupConfig{
+			{Name: "heat", Members: []string{"valve1"}, Interlock: []string{"cool"}},
+			{Name: "cool", Members: []string{"valve2"}},
+		},
+	})
+	now := time.Date(2026, 10, 12, 12, 0, 0, 0, time.UTC)
+	ago := func(seconds int) time.Time {
+		return now.Add(-time.Duration(seconds) * time.Second)
+	}
+
+	tests := []struct {
+		name    string
+		output  string
+		current int
+		state   int
+		// last switch and switch ons, zero and nil without history
+		changedAt time.Time
+		starts    []time.Time
+		coolOn    bool
+		wantRule  string
+		wantWait  time.Duration
+	}{
+		{name: "same state", output: "boiler", current: 1, state: 1, changedAt: ago(1)},
+		{name: "no history", output: "boiler", current: 0, state: 1},
+		{name: "min_on", output: "boiler", current: 1, state: 0, changedAt: ago(20), wantRule: "min_on", wantWait: 40 * time.Second},
+		{name: "min_on elapsed", output: "boiler", current: 1, state: 0, changedAt: ago(60)},
+		{name: "min_off", output: "boiler", current: 0, state: 1, changedAt: ago(100), wantRule: "min_off", wantWait: 20 * time.Second},
+		{name: "min_off elapsed", output: "boiler", current: 0, state: 1, changedAt: ago(120)},
+		{name: "max_switches_per_hour", output: "boiler", current: 0, state: 1, changedAt: ago(600),
+			starts: []time.Time{ago(3000), ago(900)}, wantRule: "max_switches_per_hour", wantWait: 600 * time.Second},
+		{name: "switches older than an hour", output: "boiler", current: 0, state: 1, changedAt: ago(600),
+			starts: []time.Time{ago(4000), ago(900)}},
+		{name: "switching off is not counted", output: "boiler", current: 1, state: 0, changedAt: ago(600),
+			starts: []time.Time{ago(3000), ago(900)}},
+		{name: "no protection", output: "light", current: 1, state: 0, changedAt: ago(1)},
+		{name: "interlock", output: "heat", current: 0, state: 1, coolOn: true, wantRule: "interlock"},
+		{name: "interlock off", output: "heat", current: 0, state: 1},
+		{name: "interlock only on switch on", output: "heat", current: 1, state: 0, coolOn: true},
+	}
+	for _, tt := range tests {
+		outputHistoriesMu.Lock()
+		outputHistories = map[string]*outputHistory{}
+		if !tt.changedAt.IsZero() {
+			outputHistories[tt.output] = &outputHistory{changedAt: tt.changedAt, starts: tt.starts}
+		}
+		outputHistoriesMu.Unlock()
+
+		outputStatesMu.Lock()
+		outputStates = map[string]int{"cool": 0}
+		if tt.coolOn {
+			outputStates["cool"] = 1
+		}
+		outputStatesMu.Unlock()
+
+		err := checkProtection(tt.output, tt.current, tt.state, now)
+		if len(tt.wantRule) == 0 {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+			continue
+		}
+		perr, ok := err.(*ProtectionError)
+		if !ok {
+			t.Errorf("%s: error = %v, want %s refusal", tt.name, err, tt.wantRule)
+			continue
+		}
+		if perr.Rule != tt.wantRule || perr.Wait != tt.wantWait {
+			t.Errorf("%s: refused by %s waiting %s, want %s waiting %s", tt.name, perr.Rule, perr.Wait, tt.wantRule, tt.wantWait)
+		}
+	}
+}
+
+func TestRecordSwitch(t *testing.T) {
+	useConfig(t, FortinoConfig{
+		DigitalOutputs: []DigitalOutputConfig{
+			{Name: "boiler", PIN: 5, Protection: ProtectionConfig{MaxSwitchesPerHour: 2}},
+		},
+	})
+	outputHistoriesMu.Lock()
+	outputHistories = map[string]*outputHistory{}
+	outputHistoriesMu.Unlock()
+
+	now := time.Date(2026, 10, 12, 12, 0, 0, 0, time.UTC)
+	for i, state := range []int{1, 0, 1, 0} {
+		recordSwitch("boiler", state, now.Add(time.Duration(i)*time.Minute))
+	}
+
+	err := checkProtection("boiler", 0, 1, now.Add(10*time.Minute))
+	if perr, ok := err.(*ProtectionError); !ok || perr.Rule != "max_switches_per_hour" {
+		t.Errorf("third switch on in an hour: error = %v, want max_switches_per_hour", err)
+	}
+	if err := checkProtection("boiler", 0, 1, now.Add(61*time.Minute)); err != nil {
+		t.Errorf("after an hour: %v", err)
+	}
+}
+
+func TestMaxOnLatch(t *testing.T) {
+	useConfig(t, FortinoConfig{
+		DigitalOutputs: []DigitalOutputConfig{
+			{Name: "boiler", PIN: 5, Protection: ProtectionConfig{MaxOn: 3600}},
+		},
+	})
+	now := time.Date(2026, 10, 12, 12, 0, 0, 0, time.UTC)
+	outputHistoriesMu.Lock()
+	outputHistories = map[string]*outputHistory{"boiler": {changedAt: now.Add(-time.Hour), latched: true}}
+	outputHistoriesMu.Unlock()
+
+	err := checkProtection("boiler", 0, 1, now)
+	if perr, ok := err.(*ProtectionError); !ok || perr.Rule != "max_on" {
+		t.Errorf("latched: error = %v, want max_on", err)
+	}
+	if err := checkProtection("boiler", 1, 0, now); err != nil {
+		t.Errorf("latched, switching off: %v", err)
+	}
+
+	releaseMaxOnLatch("boiler")
+	if err := checkProtection("boiler", 0, 1, now); err != nil {
+		t.Errorf("released: %v", err)
+	}
+}
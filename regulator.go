@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+type PIDConfig struct {
+	Kp float64 `json:"kp"`
+	Ki float64 `json:"ki"`
+	Kd float64 `json:"kd"`
+	// "time_proportional" (default) drives the relay with a duty cycle over
+	// CycleTime seconds, "onoff" switches it on above 50% demand
+	OutputMode string `json:"output_mode"`
+	CycleTime  uint   `json:"cycle_time"`
+}
+
+// Regulator turns setpoint and measured temperature into a heating demand
+// between 0 (off) and 1 (fully on), t carries the current tuning
+type Regulator interface {
+	Update(t Thermostat, setpoint float64, measured float64, dt time.Duration) float64
+	Reset()
+}
+
+func NewRegulator(name string) (Regulator, error) {
+	switch name {
+	case "", "bangbang":
+		return &bangBangRegulator{}, nil
+	case "pid":
+		return &pidRegulator{}, nil
+	}
+	return nil, fmt.Errorf("unknown regulator '%s'", name)
+}
+
+// On/off with hysteresis around the setpoint
+type bangBangRegulator struct {
+	on bool
+}
+
+func (r *bangBangRegulator) Update(t Thermostat, setpoint float64, measured float64, dt time.Duration) float64 {
+	tempErr := setpoint - measured
+	if tempErr > t.Hysteresis {
+		r.on = true
+	} else if tempErr < -t.Hysteresis {
+		r.on = false
+	}
+	if r.on {
+		return 1
+	}
+	return 0
+}
+
+func (r *bangBangRegulator) Reset() {
+	r.on = false
+}
+
+// Gains are per C of error, Ki per second and Kd in seconds. The
+// derivative acts on the measurement so setpoint changes don't kick.
+type pidRegulator struct {
+	integral     float64
+	lastMeasured float64
+	initialized  bool
+}
+
+func (r *pidRegulator) Update(t Thermostat, setpoint float64, measured float64, dt time.Duration) float64 {
+	gains := t.PID
+	tempErr := setpoint - measured
+	seconds := dt.Seconds()
+
+	derivative := 0.0
+	if r.initialized && seconds > 0 {
+		derivative = -(measured - r.lastMeasured) / seconds
+	}
+	r.lastMeasured = measured
+	r.initialized = true
+
+	proportional := gains.Kp * tempErr
+	integral := r.integral + gains.Ki*tempErr*seconds
+
+	// Anti windup: stop integrating while the output is saturated in the
+	// same direction of the error, and never let the term alone exceed
+	// the output range
+	output := proportional + integral + gains.Kd*derivative
+	if (output > 1 && tempErr > 0) || (output < 0 && tempErr < 0) {
+		integral = r.integral
+	}
+	r.integral = math.Max(0, math.Min(1, integral))
+
+	output = proportional + r.integral + gains.Kd*derivative
+	return math.Max(0, math.Min(1, output))
+}
+
+func (r *pidRegulator) Reset() {
+	r.integral = 0
+	r.initialized = false
+}
+
+// timeProportioner spreads a demand over a cycle window: on for
+// demand*cycle, then off for the rest of the window
+type timeProportioner struct {
+	cycle       time.Duration
+	windowStart time.Time
+}
+
+func (p *timeProportioner) On(demand float64, now time.Time) bool {
+	if now.Sub(p.windowStart) >= p.cycle {
+		p.windowStart = now
+	}
+	onTime := time.Duration(demand * float64(p.cycle))
+	return now.Sub(p.windowStart) < onTime
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBangBangRegulator(t *testing.T) {
+	cfg := Thermostat{Hysteresis: 0.5}
+	r := &bangBangRegulator{}
+	steps := []struct {
+		measured float64
+		want     float64
+	}{
+		{19.0, 1},
+		{19.8, 1},
+		{20.4, 1},
+		{20.6, 0},
+		{19.6, 0},
+		{19.4, 1},
+	}
+	for i, s := range steps {
+		if got := r.Update(cfg, 20, s.measured, time.Minute); got != s.want {
+			t.Errorf("step %d, measured %v: demand %v, want %v", i, s.measured, got, s.want)
+		}
+	}
+}
+
+func TestPIDRegulator(t *testing.T) {
+	tests := []struct {
+		name     string
+		pid      PIDConfig
+		measured []float64
+		want     []float64
+	}{
+		{"proportional", PIDConfig{Kp: 0.5}, []float64{19, 19.5, 20, 21}, []float64{0.5, 0.25, 0, 0}},
+		{"saturated", PIDConfig{Kp: 0.5}, []float64{15}, []float64{1}},
+		// 0.001 per C per second, 100 s steps at 1 C of error
+		{"integral", PIDConfig{Ki: 0.001}, []float64{19, 19, 19}, []float64{0.1, 0.2, 0.3}},
+		// derivative on the measurement, 0.5 C rise in 100 s
+		{"derivative", PIDConfig{Kp: 0.5, Kd: 100}, []float64{19, 19.5}, []float64{0.5, 0}},
+	}
+	for _, tt := range tests {
+		r := &pidRegulator{}
+		cfg := Thermostat{PID: tt.pid}
+		for i, measured := range tt.measured {
+			got := r.Update(cfg, 20, measured, 100*time.Second)
+			if diff := got - tt.want[i]; diff > 1e-9 || diff < -1e-9 {
+				t.Errorf("%s: step %d, measured %v: demand %v, want %v", tt.name, i, measured, got, tt.want[i])
+			}
+		}
+	}
+}
+
+func TestPIDRegulatorAntiWindup(t *testing.T) {
+	r := &pidRegulator{}
+	cfg := Thermostat{PID: PIDConfig{Kp: 1, Ki: 0.01}}
+	// A long saturated heat up must not charge the integral
+	for i := 0; i < 100; i++ {
+		r.Update(cfg, 20, 10, 100*time.Second)
+	}
+	if r.integral != 0 {
+		t.Errorf("integral %v after saturation, want 0", r.integral)
+	}
+
+	r.Reset()
+	for i := 0; i < 100; i++ {
+		r.Update(Thermostat{PID: PIDConfig{Ki: 0.01}}, 20, 19, 100*time.Second)
+	}
+	if r.integral > 1 {
+		t.Errorf("integral %v, want at most 1", r.integral)
+	}
+}
+
+func TestTimeProportioner(t *testing.T) {
+	start := time.Date(2026, 10, 12, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		demand float64
+		at     time.Duration
+		want   bool
+	}{
+		{0.25, 0, true},
+		{0.25, 2 * time.Minute, true},
+		{0.25, 2*time.Minute + 30*time.Second, false},
+		{0.25, 9 * time.Minute, false},
+		// a new window starts
+		{0.25, 10 * time.Minute, true},
+		{0, 10*time.Minute + time.Second, false},
+		{1, 19 * time.Minute, true},
+	}
+	p := &timeProportioner{cycle: 10 * time.Minute}
+	for _, tt := range tests {
+		if got := p.On(tt.demand, start.Add(tt.at)); got != tt.want {
+			t.Errorf("demand %v at %s: on %v, want %v", tt.demand, tt.at, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// RuleConfig runs its actions, in order, every time the trigger fires.
+// Rules are evaluated locally and keep working without the broker,
+// except for the mqtt trigger and the publish action.
+type RuleConfig struct {
+	Name    string       `json:"name"`
+	Enabled bool         `json:"enabled"`
+	Trigger RuleTrigger  `json:"trigger"`
+	Actions []RuleAction `json:"actions"`
+}
+
+// RuleTrigger fields depend on the type:
+//   - sensor: fires when Sensor goes above Above or below Below, then
+//     again once it came back by Hysteresis
+//   - input: fires on the Edge (rising, falling or both) of Input
+//   - time: fires at At ("HH:MM" local time) on Days, es. ["weekdays"],
+//     every day when empty
+//   - mqtt: fires on a message on Topic, wildcards allowed, with Payload
+//     when set
+type RuleTrigger struct {
+	Type       string   `json:"type"`
+	Sensor     string   `json:"sensor,omitempty"`
+	Above      *float64 `json:"above,omitempty"`
+	Below      *float64 `json:"below,omitempty"`
+	Hysteresis float64  `json:"hysteresis,omitempty"`
+	Input      string   `json:"input,omitempty"`
+	Edge       string   `json:"edge,omitempty"`
+	At         string   `json:"at,omitempty"`
+	Days       []string `json:"days,omitempty"`
+	Topic      string   `json:"topic,omitempty"`
+	Payload    string   `json:"payload,omitempty"`
+}
+
+// RuleAction fields depend on the type:
+//   - output: switches Output to State (on, off or toggle)
+//   - setpoint: sets the Zone setpoint, for Duration when given (es. 2h)
+//   - publish: publishes Payload on Topic
+//   - sms: sends Message to the allowed phones
+type RuleAction struct {
+	Type     string   `json:"type"`
+	Output   string   `json:"output,omitempty"`
+	State    string   `json:"state,omitempty"`
+	Zone     string   `json:"zone,omitempty"`
+	Setpoint *float64 `json:"setpoint,omitempty"`
+	Duration string   `json:"duration,omitempty"`
+	Topic    string   `json:"topic,omitempty"`
+	Payload  string   `json:"payload,omitempty"`
+	Retain   bool     `json:"retain,omitempty"`
+	Message  string   `json:"message,omitempty"`
+}
+
+var ruleTriggerTypes = []string{"sensor", "input", "time", "mqtt"}
+var ruleActionTypes = []string{"output", "setpoint", "publish", "sms"}
+
+// runtime state of a rule, published on stat/<topic>/RULES
+type ruleState struct {
+	cfg RuleConfig
+	// time trigger, day it last fired
+	firedOn string
+
+	Enabled   bool       `json:"Enabled"`
+	Active    bool       `json:"Active"`
+	Fired     int        `json:"Fired"`
+	LastFired *time.Time `json:"LastFired,omitempty"`
+	Error     string     `json:"Error,omitempty"`
+}
+
+var ruleStates = map[string]*ruleState{}
+var ruleStatesMu sync.Mutex
+
+// rule actions run in order, apart from the triggers
+var ruleEvents = make(chan func(), 64)
+
+// mqtt trigger topics currently subscribed
+var ruleTopics = map[string]bool{}
+var ruleTopicsMu sync.Mutex
+
+var rulesRoutineOnce sync.Once
+
+func startRulesRoutine() {
+	rulesRoutineOnce.Do(func() {
+		OnInputEdge(inputRules)
+		go func() {
+			for event := range ruleEvents {
+				event()
+			}
+		}()
+		go RulesRoutine()
+	})
+}
+
+// syncRuleStates matches the states to the configured rules, a rule
+// whose config changed starts over
+func syncRuleStates() {
+	ruleStatesMu.Lock()
+	defer ruleStatesMu.Unlock()
+
+	names := map[string]bool{}
+	for _, r := range getConfig().Rules {
+		names[r.Name] = true
+		if s, ok := ruleStates[r.Name]; ok && reflect.DeepEqual(s.cfg, r) {
+			continue
+		}
+		ruleStates[r.Name] = &ruleState{cfg: r, Enabled: r.Enabled}
+	}
+	for name := range ruleStates {
+		if !names[name] {
+			delete(ruleStates, name)
+		}
+	}
+}
+
+// RulesRoutine evaluates the sensor and time triggers every second
+func RulesRoutine() {
+	for {
+		syncRuleStates()
+
+		now := time.Now()
+		samples := map[string]SensorSample{}
+		for _, s := range LatestSamples() {
+			samples[s.Name] = s
+		}
+
+		for _, r := range getConfig().Rules {
+			switch r.Trigger.Type {
+			case "sensor":
+				s, ok := samples[r.Trigger.Sensor]
+				if !ok || s.Status != "ok" {
+					continue
+				}
+				sensorRule(r, s.fValue)
+			case "time":
+				timeRule(r, now)
+			}
+		}
+
+		time.Sleep(time.Second)
+	}
+}
+
+// sensorRule fires on the threshold crossing, the rule stays active and
+// doesn't fire again until the value is back past the hysteresis
+func sensorRule(r RuleConfig, value float64) {
+	t := r.Trigger
+
+	ruleStatesMu.Lock()
+	s, ok := ruleStates[r.Name]
+	if !ok {
+		ruleStatesMu.Unlock()
+		return
+	}
+	active := s.Active
+	if t.Above != nil {
+		active = value > *t.Above || (active && value > *t.Above-t.Hysteresis)
+	} else if t.Below != nil {
+		active = value < *t.Below || (active && value < *t.Below+t.Hysteresis)
+	}
+	changed := active != s.Active
+	s.Active = active
+	ruleStatesMu.Unlock()
+
+	if changed && active {
+		fireRule(r, fmt.Sprintf("%s %.2f", t.Sensor, value))
+	} else if changed {
+		PublishRulesState()
+	}
+}
+
+func timeRule(r RuleConfig, now time.Time) {
+	hour, minute, err := parseSlotTime(r.Trigger.At)
+	if err != nil || now.Hour() != hour || now.Minute() != minute || !ruleDayMatches(r.Trigger.Days, now.Weekday()) {
+		return
+	}
+
+	day := now.Format("2006-01-02")
+	ruleStatesMu.Lock()
+	s, ok := ruleStates[r.Name]
+	fired := ok && s.firedOn == day
+	if ok {
+		s.firedOn = day
+	}
+	ruleStatesMu.Unlock()
+
+	if ok && !fired {
+		fireRule(r, r.Trigger.At)
+	}
+}
+
+func ruleDayMatches(days []string, day time.Weekday) bool {
+	if len(days) == 0 {
+		return true
+	}
+	weekend := day == time.Saturday || day == time.Sunday
+	for _, d := range days {
+		if d == "daily" || d == scheduleDayKeys[day] || (d == "weekend" && weekend) || (d == "weekdays" && !weekend) {
+			return true
+		}
+	}
+	return false
+}
+
+func inputRules(in DigitalInputConfig, state bool) {
+	for _, r := range getConfig().Rules {
+		if r.Trigger.Type != "input" || r.Trigger.Input != in.Name {
+			continue
+		}
+		if (r.Trigger.Edge == "rising" && !state) || (r.Trigger.Edge == "falling" && state) {
+			continue
+		}
+		fireRule(r, fmt.Sprintf("%s %t", in.Name, state))
+	}
+}
+
+var rulesMQTTHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
+	payload := strings.TrimSpace(string(msg.Payload()))
+	for _, r := range getConfig().Rules {
+		if r.Trigger.Type != "mqtt" || !mqttTopicMatches(r.Trigger.Topic, msg.Topic()) {
+			continue
+		}
+		if len(r.Trigger.Payload) > 0 && !strings.EqualFold(r.Trigger.Payload, payload) {
+			continue
+		}
+		fireRule(r, msg.Topic())
+	}
+}
+
+// mqttTopicMatches matches a topic against a subscription filter with
+// the + and # wildcards
+func mqttTopicMatches(filter string, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, f := range filterLevels {
+		if f == "#" {
+			return true
+		}
+		if i >= len(topicLevels) || (f != "+" && f != topicLevels[i]) {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+// subscribeRuleTopics subscribes the mqtt trigger topics, dropping the
+// ones no longer used. A new connection subscribes them all again.
+func subscribeRuleTopics(c mqtt.Client, reconnected bool) {
+	if c == nil || !c.IsConnected() {
+		return
+	}
+
+	topics := map[string]bool{}
+	for _, r := range getConfig().Rules {
+		if r.Trigger.Type == "mqtt" {
+			topics[r.Trigger.Topic] = true
+		}
+	}
+
+	ruleTopicsMu.Lock()
+	defer ruleTopicsMu.Unlock()
+
+	if reconnected {
+		ruleTopics = map[string]bool{}
+	}
+	for topic := range ruleTopics {
+		if !topics[topic] {
+			c.Unsubscribe(topic)
+			delete(ruleTopics, topic)
+		}
+	}
+	for topic := range topics {
+		if ruleTopics[topic] {
+			continue
+		}
+		if token := c.Subscribe(topic, 0, rulesMQTTHandler); token.Wait() && token.Error() != nil {
+			log.Printf("rules: unable to subscribe to %s: %v", topic, token.Error())
+			continue
+		}
+		ruleTopics[topic] = true
+	}
+}
+
+// fireRule queues the rule actions, reason is only logged
+func fireRule(r RuleConfig, reason string) {
+	ruleStatesMu.Lock()
+	s, ok := ruleStates[r.Name]
+	if !ok || !s.Enabled {
+		ruleStatesMu.Unlock()
+		return
+	}
+	now := time.Now().UTC()
+	s.Fired++
+	s.LastFired = &now
+	ruleStatesMu.Unlock()
+
+	log.Printf("rules: %s fired on %s", r.Name, reason)
+	select {
+	case ruleEvents <- func() { runRuleActions(r) }:
+	default:
+		log.Printf("rules: %s: too many pending actions, dropped", r.Name)
+	}
+}
+
+func runRuleActions(r RuleConfig) {
+	errs := []string{}
+	for _, a := range r.Actions {
+		err := runRuleAction(a)
+		if err != nil {
+			log.Printf("rules: %s: %v", r.Name, err)
+			errs = append(errs, err.Error())
+		}
+	}
+
+	ruleStatesMu.Lock()
+	if s, ok := ruleStates[r.Name]; ok {
+		s.Error = strings.Join(errs, "; ")
+	}
+	ruleStatesMu.Unlock()
+
+	PublishRulesState()
+}
+
+func runRuleAction(a RuleAction) error {
+	switch a.Type {
+	case "output":
+		_, err := SetOutputPower(a.Output, a.State)
+		return err
+	case "setpoint":
+		zone, ok := FindZone(a.Zone)
+		if !ok {
+			return fmt.Errorf("unknown thermostat zone '%s'", a.Zone)
+		}
+		duration, err := parseOverrideDuration(strings.Fields(a.Duration))
+		if err != nil {
+			return err
+		}
+		return zone.SetSetpointFor(*a.Setpoint, duration)
+	case "publish":
+		client := getMQTTClient()
+		if client == nil || !client.IsConnected() {
+			return fmt.Errorf("publish on %s: mqtt not connected", a.Topic)
+		}
+		client.Publish(a.Topic, 0, a.Retain, a.Payload)
+	case "sms":
+		NotifyPhones(a.Message)
+	default:
+		return fmt.Errorf("unknown action '%s'", a.Type)
+	}
+	return nil
+}
+
+// SetRuleEnabled enables or disables a rule until the next restart or
+// config change
+func SetRuleEnabled(name string, enabled bool) error {
+	ruleStatesMu.Lock()
+	s, ok := ruleStates[name]
+	if ok {
+		s.Enabled = enabled
+	}
+	ruleStatesMu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("unknown rule '%s'", name)
+	}
+	log.Printf("rules: %s enabled %t", name, enabled)
+	PublishRulesState()
+	return nil
+}
+
+func RuleEnabled(name string) (bool, bool) {
+	ruleStatesMu.Lock()
+	defer ruleStatesMu.Unlock()
+	s, ok := ruleStates[name]
+	if !ok {
+		return false, false
+	}
+	return s.Enabled, true
+}
+
+// PublishRulesState publishes the retained state of every rule on
+// stat/<topic>/RULES
+func PublishRulesState() {
+	client := getMQTTClient()
+	if client == nil {
+		return
+	}
+
+	ruleStatesMu.Lock()
+	jsonStr, err := json.Marshal(map[string]interface{}{
+		"Time":  time.Now().UTC().Format(MQTT_DATETIME_FORMAT),
+		"Rules": ruleStates,
+	})
+	ruleStatesMu.Unlock()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	client.Publish(fmt.Sprintf("stat/%s/RULES", getConfig().MQTT.Topic), 0, true, jsonStr)
+}
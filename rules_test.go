@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestMQTTTopicMatches(t *testing.T) {
+	tests := []struct {
+		filter string
+		topic  string
+		want   bool
+	}{
+		{"home/presence", "home/presence", true},
+		{"home/presence", "home/presence/x", false},
+		{"home/presence/x", "home/presence", false},
+		{"home/+", "home/presence", true},
+		{"home/+", "home/presence/x", false},
+		{"home/+/temp", "home/kitchen/temp", true},
+		{"home/+/temp", "home/kitchen/humidity", false},
+		{"home/#", "home", true},
+		{"home/#", "home/kitchen/temp", true},
+		{"#", "anything/at/all", true},
+		{"+", "home", true},
+		{"Home/presence", "home/presence", false},
+	}
+	for _, tt := range tests {
+		if got := mqttTopicMatches(tt.filter, tt.topic); got != tt.want {
+			t.Errorf("mqttTopicMatches(%q, %q) = %v, want %v", tt.filter, tt.topic, got, tt.want)
+		}
+	}
+}
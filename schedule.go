@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ScheduleConfig is a weekly list of setpoint changes. Week keys are
+// mon..sun, a day without its own slots falls back to "weekdays" or
+// "weekend" and then to "daily".
+type ScheduleConfig struct {
+	Enabled bool                      `json:"enabled"`
+	Presets map[string]float64        `json:"presets"`
+	Week    map[string][]ScheduleSlot `json:"week"`
+}
+
+// ScheduleSlot starts at "HH:MM" local time, with either a preset name or
+// an explicit setpoint
+type ScheduleSlot struct {
+	At       string   `json:"at"`
+	Preset   string   `json:"preset"`
+	Setpoint *float64 `json:"setpoint"`
+}
+
+var scheduleDayKeys = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+func (s *ScheduleConfig) slotsFor(day time.Weekday) []ScheduleSlot {
+	if slots, ok := s.Week[scheduleDayKeys[day]]; ok {
+		return slots
+	}
+	if day == time.Saturday || day == time.Sunday {
+		if slots, ok := s.Week["weekend"]; ok {
+			return slots
+		}
+	} else if slots, ok := s.Week["weekdays"]; ok {
+		return slots
+	}
+	return s.Week["daily"]
+}
+
+func (s *ScheduleConfig) PresetSetpoint(name string) (float64, bool) {
+	for preset, setpoint := range s.Presets {
+		if strings.EqualFold(preset, name) {
+			return setpoint, true
+		}
+	}
+	return 0, false
+}
+
+func (s *ScheduleConfig) SlotSetpoint(slot ScheduleSlot) (float64, error) {
+	if slot.Setpoint != nil {
+		return *slot.Setpoint, nil
+	}
+	setpoint, ok := s.PresetSetpoint(slot.Preset)
+	if !ok {
+		return 0, fmt.Errorf("schedule: unknown preset '%s' at %s", slot.Preset, slot.At)
+	}
+	return setpoint, nil
+}
+
+func parseSlotTime(at string) (int, int, error) {
+	t := strings.SplitN(at, ":", 2)
+	if len(t) != 2 {
+		return 0, 0, fmt.Errorf("schedule: invalid time '%s', expected HH:MM", at)
+	}
+	hour, err := strconv.Atoi(t[0])
+	if err != nil || hour < 0 || hour > 23 {
+		return 0, 0, fmt.Errorf("schedule: invalid hour in '%s'", at)
+	}
+	minute, err := strconv.Atoi(t[1])
+	if err != nil || minute < 0 || minute > 59 {
+		return 0, 0, fmt.Errorf("schedule: invalid minute in '%s'", at)
+	}
+	return hour, minute, nil
+}
+
+type scheduleOccurrence struct {
+	start time.Time
+	slot  ScheduleSlot
+}
+
+// occurrences lists the slot starts from a week before to a week after now
+func (s *ScheduleConfig) occurrences(now time.Time) []scheduleOccurrence {
+	occurrences := []scheduleOccurrence{}
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	for d := -7; d <= 7; d++ {
+		day := midnight.AddDate(0, 0, d)
+		for _, slot := range s.slotsFor(day.Weekday()) {
+			hour, minute, err := parseSlotTime(slot.At)
+			if err != nil {
+				continue
+			}
+			start := time.Date(day.Year(), day.Month(), day.Day(), hour, minute, 0, 0, now.Location())
+			occurrences = append(occurrences, scheduleOccurrence{start: start, slot: slot})
+		}
+	}
+	return occurrences
+}
+
+// Active returns the start and the setpoint of the slot running at now
+func (s *ScheduleConfig) Active(now time.Time) (time.Time, float64, error) {
+	var active *scheduleOccurrence
+	occurrences := s.occurrences(now)
+	for i, o := range occurrences {
+		if o.start.After(now) {
+			continue
+		}
+		if active == nil || o.start.After(active.start) {
+			active = &occurrences[i]
+		}
+	}
+	if active == nil {
+		return time.Time{}, 0, fmt.Errorf("schedule: no slots defined")
+	}
+	setpoint, err := s.SlotSetpoint(active.slot)
+	return active.start, setpoint, err
+}
+
+// Next returns the start of the first slot after now, zero when there is none
+func (s *ScheduleConfig) Next(now time.Time) time.Time {
+	var next time.Time
+	for _, o := range s.occurrences(now) {
+		if o.start.After(now) && (next.IsZero() || o.start.Before(next)) {
+			next = o.start
+		}
+	}
+	return next
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func testSchedule() *ScheduleConfig {
+	nineteen := 19.0
+	return &ScheduleConfig{
+		Enabled: true,
+		Presets: map[string]float64{"comfort": 21, "eco": 17},
+		Week: map[string][]ScheduleSlot{
+			"weekdays": {{At: "06:30", Preset: "comfort"}, {At: "22:00", Preset: "eco"}},
+			"weekend":  {{At: "08:00", Preset: "comfort"}, {At: "23:00", Preset: "eco"}},
+			"wed":      {{At: "12:00", Setpoint: &nineteen}},
+		},
+	}
+}
+
+// 2026-10-12 is a Monday
+func scheduleTime(day int, hour int, minute int) time.Time {
+	return time.Date(2026, 10, day, hour, minute, 0, 0, time.UTC)
+}
+
+func TestScheduleActive(t *testing.T) {
+	s := testSchedule()
+	tests := []struct {
+		name      string
+		now       time.Time
+		wantStart time.Time
+		want      float64
+	}{
+		{"weekday morning", scheduleTime(12, 7, 0), scheduleTime(12, 6, 30), 21},
+		{"slot start", scheduleTime(12, 6, 30), scheduleTime(12, 6, 30), 21},
+		{"before the first slot of the day", scheduleTime(12, 5, 0), scheduleTime(11, 23, 0), 17},
+		{"weekday night", scheduleTime(13, 23, 59), scheduleTime(13, 22, 0), 17},
+		{"own day slots", scheduleTime(14, 13, 0), scheduleTime(14, 12, 0), 19},
+		{"own day, earlier slot from the day before", scheduleTime(14, 11, 0), scheduleTime(13, 22, 0), 17},
+		{"weekend before the first slot", scheduleTime(17, 7, 59), scheduleTime(16, 22, 0), 17},
+		{"weekend", scheduleTime(18, 9, 0), scheduleTime(18, 8, 0), 21},
+	}
+	for _, tt := range tests {
+		start, setpoint, err := s.Active(tt.now)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !start.Equal(tt.wantStart) || setpoint != tt.want {
+			t.Errorf("%s: Active(%s) = %s, %v, want %s, %v", tt.name, tt.now, start, setpoint, tt.wantStart, tt.want)
+		}
+	}
+}
+
+func TestScheduleActiveErrors(t *testing.T) {
+	empty := &ScheduleConfig{Enabled: true}
+	if _, _, err := empty.Active(scheduleTime(12, 12, 0)); err == nil {
+		t.Error("empty schedule: no error")
+	}
+
+	unknown := &ScheduleConfig{Week: map[string][]ScheduleSlot{"daily": {{At: "07:00", Preset: "away"}}}}
+	if _, _, err := unknown.Active(scheduleTime(12, 12, 0)); err == nil {
+		t.Error("unknown preset: no error")
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+	s := testSchedule()
+	tests := []struct {
+		name string
+		now  time.Time
+		want time.Time
+	}{
+		{"same day", scheduleTime(12, 7, 0), scheduleTime(12, 22, 0)},
+		{"at a slot start", scheduleTime(12, 6, 30), scheduleTime(12, 22, 0)},
+		{"next day", scheduleTime(12, 22, 30), scheduleTime(13, 6, 30)},
+		{"into the weekend", scheduleTime(16, 22, 30), scheduleTime(17, 8, 0)},
+		{"own day slots", scheduleTime(14, 11, 0), scheduleTime(14, 12, 0)},
+		{"after the own day slots", scheduleTime(14, 13, 0), scheduleTime(15, 6, 30)},
+	}
+	for _, tt := range tests {
+		if got := s.Next(tt.now); !got.Equal(tt.want) {
+			t.Errorf("%s: Next(%s) = %s, want %s", tt.name, tt.now, got, tt.want)
+		}
+	}
+
+	empty := &ScheduleConfig{}
+	if got := empty.Next(scheduleTime(12, 12, 0)); !got.IsZero() {
+		t.Errorf("empty schedule: Next = %s, want zero", got)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// SensorDriver reads a temperature in C from a configured sensor, drivers
+// are selected by OneWireSensor.Type.
+type SensorDriver interface {
+	ReadTemp(s OneWireSensor) (float64, error)
+}
+
+var sensorDrivers = map[string]SensorDriver{
+	"DS18B20":  w1ThermDriver{},
+	"DS18S20":  w1ThermDriver{},
+	"DS1822":   w1ThermDriver{},
+	"MAX31850": w1ThermDriver{},
+	"THERMAL":  thermalZoneDriver{},
+}
+
+// last sample of each sensor, by sensor name
+var latestSamples = map[string]SensorSample{}
+var latestSamplesMu sync.Mutex
+
+func StoreSample(sample SensorSample) {
+	latestSamplesMu.Lock()
+	defer latestSamplesMu.Unlock()
+
+	// A failed read keeps the last good value around
+	if prev, ok := latestSamples[sample.Name]; ok && sample.Status != "ok" {
+		sample.fValue = prev.fValue
+	}
+	latestSamples[sample.Name] = sample
+}
+
+func LatestSamples() []SensorSample {
+	latestSamplesMu.Lock()
+	defer latestSamplesMu.Unlock()
+
+	samples := make([]SensorSample, 0, len(latestSamples))
+	for _, s := range latestSamples {
+		samples = append(samples, s)
+	}
+	return samples
+}
+
+func RegisterSensorDriver(sensorType string, d SensorDriver) {
+	sensorDrivers[strings.ToUpper(sensorType)] = d
+}
+
+func SensorDriverFor(sensorType string) (SensorDriver, bool) {
+	d, ok := sensorDrivers[strings.ToUpper(sensorType)]
+	return d, ok
+}
+
+func ReadSensor(s OneWireSensor) (float64, error) {
+	d, ok := SensorDriverFor(s.Type)
+	if !ok {
+		return 0, fmt.Errorf("sensor: unknown type '%s' for %s", s.Type, s.Name)
+	}
+	return d.ReadTemp(s)
+}
+
+func FindSensor(name string) (OneWireSensor, bool) {
+	for _, s := range getConfig().Onewires {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return OneWireSensor{}, false
+}
+
+// sysfsPath prefixes an absolute sysfs/procfs path with the configured
+// root, so a fake tree can be used off target.
+func sysfsPath(path string) string {
+	config := getConfig()
+
+	if len(config.SysfsRoot) == 0 {
+		return path
+	}
+	return filepath.Join(config.SysfsRoot, path)
+}
+
+// w1_therm kernel driver, all the supported families share the w1_slave format
+type w1ThermDriver struct{}
+
+func (w1ThermDriver) ReadTemp(s OneWireSensor) (float64, error) {
+	return ReadTemp_DS18B20(s.ID)
+}
+
+// ID is the thermal zone name, es. thermal_zone0
+type thermalZoneDriver struct{}
+
+func (thermalZoneDriver) ReadTemp(s OneWireSensor) (float64, error) {
+	dat, err := os.ReadFile(sysfsPath(fmt.Sprintf("/sys/class/thermal/%s/temp", s.ID)))
+	if err != nil {
+		countSensorReadError(s.ID)
+		return 0, err
+	}
+	tempInMilli, err := strconv.Atoi(strings.TrimSpace(string(dat)))
+	if err != nil {
+		countSensorReadError(s.ID)
+		return 0, err
+	}
+	return float64(tempInMilli) / 1000.0, nil
+}
+
+func ReadTemp_DS18B20(ID string) (float64, error) {
+
+	w1BusPath := sysfsPath(fmt.Sprintf("/sys/bus/w1/devices/%s/w1_slave", ID))
+	dat, err := os.ReadFile(w1BusPath)
+	if err != nil {
+		log.Printf("%s", string(err.Error()))
+		countSensorReadError(ID)
+		return -10000, err
+	}
+
+	lines := strings.Split(string(dat), "\n")
+	if len(lines) < 2 {
+		log.Println("onewire: invalid DS18B20 bus payload")
+		countSensorReadError(ID)
+		return -10010, errors.New("invalid DS18B20 bus payload")
+	}
+
+	if !strings.HasSuffix(strings.TrimRight(lines[0], "\r\n"), "YES") {
+		log.Println("onewire: invalid DS18B20 CRC")
+		countSensorReadError(ID)
+		return -10020, errors.New("invalid DS18B20 CRC")
+	}
+
+	if strings.Count(lines[1], "=") != 1 {
+		log.Println("onewire: invalid DS18B20 format")
+		countSensorReadError(ID)
+		return -10030, errors.New("invalid DS18B20 fortmat")
+	}
+
+	equalSignIndex := strings.Index(lines[1], "=")
+	if equalSignIndex > 0 {
+		tempInMilliC := lines[1][(equalSignIndex + 1):len(lines[1])]
+		tempInMilli, err := strconv.Atoi(tempInMilliC)
+		if err != nil {
+			countSensorReadError(ID)
+			return -10040, err
+		}
+		return float64(tempInMilli) / 1000.0, nil
+	}
+
+	panic("onewire: counted 1 equal sign, found none")
+}
+
+func RPI_GetInfo() (map[string]string, error) {
+
+	dict := make(map[string]string)
+
+	dat, err := os.ReadFile(sysfsPath("/proc/cpuinfo"))
+	if err != nil {
+		return dict, err
+	}
+
+	lines := strings.Split(string(dat), "\n")
+	for _, l := range lines {
+		if strings.HasPrefix(l, "Serial") {
+			t := strings.Split(l, ":")
+			if len(t) < 2 {
+				panic("/proc/cpuinfo Serial : wrong format")
+			}
+			dict["cpu_serial"] = strings.Trim(t[1], " ")
+		}
+	}
+
+	dat, err = os.ReadFile(sysfsPath("/sys/class/thermal/thermal_zone0/temp"))
+	if err != nil {
+		return dict, err
+	}
+	dict["cpu_temp"] = strings.Trim(string(dat), "\n")
+
+	return dict, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeSysfs writes a file under root, creating the directories
+func writeSysfs(t *testing.T, root string, path string, content string) {
+	t.Helper()
+	path = filepath.Join(root, path)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadSensorDS18B20(t *testing.T) {
+	root := t.TempDir()
+	useConfig(t, FortinoConfig{SysfsRoot: root})
+
+	writeSysfs(t, root, "/sys/bus/w1/devices/28-000000000001/w1_slave",
+		"73 01 4b 46 7f ff 0d 10 41 : crc=41 YES\n73 01 4b 46 7f ff 0d 10 41 t=23187\n")
+	writeSysfs(t, root, "/sys/bus/w1/devices/28-000000000002/w1_slave",
+		"50 05 4b 46 7f ff 0c 10 1c : crc=1c YES\n50 05 4b 46 7f ff 0c 10 1c t=-1250\n")
+	writeSysfs(t, root, "/sys/bus/w1/devices/28-000000000003/w1_slave",
+		"73 01 4b 46 7f ff 0d 10 41 : crc=40 NO\n73 01 4b 46 7f ff 0d 10 41 t=23187\n")
+	writeSysfs(t, root, "/sys/bus/w1/devices/28-000000000004/w1_slave",
+		"73 01 4b 46 7f ff 0d 10 41 : crc=41 YES\n")
+	writeSysfs(t, root, "/sys/bus/w1/devices/28-000000000005/w1_slave",
+		"73 01 4b 46 7f ff 0d 10 41 : crc=41 YES\n73 01 4b 46 7f ff 0d 10 41 t=abc\n")
+
+	tests := []struct {
+		id      string
+		want    float64
+		wantErr bool
+	}{
+		{"28-000000000001", 23.187, false},
+		{"28-000000000002", -1.25, false},
+		{"28-000000000003", 0, true},
+		{"28-000000000004", 0, true},
+		{"28-000000000005", 0, true},
+		{"28-00000000000f", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ReadSensor(OneWireSensor{Name: "test", ID: tt.id, Type: "ds18b20"})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, want error %v", tt.id, err, tt.wantErr)
+			continue
+		}
+		if err == nil && got != tt.want {
+			t.Errorf("%s: temperature = %v, want %v", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestReadSensorThermalZone(t *testing.T) {
+	root := t.TempDir()
+	useConfig(t, FortinoConfig{SysfsRoot: root})
+	writeSysfs(t, root, "/sys/class/thermal/thermal_zone0/temp", "48312\n")
+
+	got, err := ReadSensor(OneWireSensor{Name: "cpu", ID: "thermal_zone0", Type: "THERMAL"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 48.312 {
+		t.Errorf("temperature = %v, want 48.312", got)
+	}
+
+	if _, err := ReadSensor(OneWireSensor{Name: "x", ID: "x", Type: "unknown"}); err == nil {
+		t.Error("unknown sensor type read without error")
+	}
+}
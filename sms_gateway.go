@@ -11,6 +11,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -26,6 +27,8 @@ type HiLinkConfig struct {
 	Enable        bool     `json:"enabled"`
 	Address       string   `json:"address"`
 	AllowedPhones []string `json:"allowed_phones"`
+
+	Queue SMSQueueConfig `json:"queue"`
 }
 
 type HiLinkMessagesResp struct {
@@ -47,10 +50,65 @@ type HiLinkMsg struct {
 	SmsType  int
 }
 
-const HELP_MSG = "puoi inviare:\naiuto\ntemp"
+// HiLink polling outcome, exported on /metrics
+var hiLinkUp bool
+var hiLinkLastOK time.Time
+var hiLinkStatusMu sync.Mutex
+
+func setHiLinkUp(up bool) {
+	hiLinkStatusMu.Lock()
+	defer hiLinkStatusMu.Unlock()
+	hiLinkUp = up
+	if up {
+		hiLinkLastOK = time.Now().UTC()
+	}
+}
+
+func GetHiLinkStatus() (bool, time.Time) {
+	hiLinkStatusMu.Lock()
+	defer hiLinkStatusMu.Unlock()
+	return hiLinkUp, hiLinkLastOK
+}
+
+const HELP_MSG = "puoi inviare:\naiuto\ntemp\nterm [zona]\nterm [zona] NN.N [2h]\nterm [zona] <preset> [2h]\nterm [zona] auto\nterm [zona] on|off|heat|cool|heat_cool|manual"
 
 // Regex that starts with '(?i)' is case insentitive
-var thermostatSetTempRegex = regexp.MustCompile(`(?i)term ([0-9]{1,2})`)
+// term [zone] NN [duration]
+var thermostatSetTempRegex = regexp.MustCompile(`(?i)^term (?:([a-z_][a-z0-9_-]*) )?(-?[0-9]{1,2}(?:[.,][0-9]{1,2})?)(?: ([0-9hms]+))?$`)
+
+// term [zone] <preset> [duration], or term <zone> for its status
+var thermostatPresetRegex = regexp.MustCompile(`(?i)^term (?:([a-z_][a-z0-9_-]*) )?([a-z0-9_-]+)(?: ([0-9hms]+))?$`)
+
+// parseTermCommand splits a term command into zone, keyword and duration.
+// The regex takes "term eco 2h" as zone eco and keyword 2h, so a first word
+// that is not a zone followed by a duration is read as <keyword> <duration>.
+func parseTermCommand(content string) (zone, keyword, duration string, ok bool) {
+	matches := thermostatPresetRegex.FindStringSubmatch(content)
+	if matches == nil {
+		return "", "", "", false
+	}
+	zone, keyword, duration = matches[1], matches[2], matches[3]
+	if len(zone) > 0 && len(duration) == 0 {
+		if _, found := FindZone(zone); !found {
+			if _, err := parseOverrideDuration([]string{keyword}); err == nil {
+				return "", zone, keyword, true
+			}
+		}
+	}
+	return zone, keyword, duration, true
+}
+
+func zoneStatusText(z *ThermostatZone) string {
+	cfg := z.Config()
+	body := fmt.Sprintf("t_setpoint = %2.1f (%s)", cfg.Setpoint, cfg.Mode)
+	if len(getZones()) > 1 {
+		body = z.Name() + ": " + body
+	}
+	if until := z.OverrideUntil(); !until.IsZero() {
+		body = body + fmt.Sprintf(" fino a %s", until.Format("Mon 15:04"))
+	}
+	return body
+}
 
 func (h *HiLink) FetchSession() error {
 
@@ -104,18 +162,21 @@ func (h *HiLink) GetToken() error {
 
 	splits := strings.SplitN(string(bodyyy), "\"", 11)
 
-	if splits[3] == "csrf_token" {
+	if len(splits) > 5 && splits[3] == "csrf_token" {
 		h.Token = splits[5]
-	} else if splits[7] == "csrf_token" {
+	} else if len(splits) > 9 && splits[7] == "csrf_token" {
 		h.Token = splits[9]
 	} else {
 		h.Token = ""
+		return fmt.Errorf("sms: no token in %s", tokenReq.URL)
 	}
 
 	log.Printf("sms: received token = %s", h.Token)
 	return nil
 }
 
+// SendMessage sends one SMS, an answer other than OK from the modem is an
+// error
 func (h *HiLink) SendMessage(number string, content string) error {
 
 	log.Printf("sms: sending %s to %s", content, number)
@@ -154,12 +215,11 @@ func (h *HiLink) SendMessage(number string, content string) error {
 	bodyyy, _ := ioutil.ReadAll(respp.Body)
 	//fmt.Println("response Body:", string(bodyyy))
 
-	if strings.Contains(string(bodyyy), "<response>OK</response>") {
-		log.Printf("sms: Message sent\n")
-	} else {
-		log.Printf("sms: received the following response: %s\n", bodyyy)
+	if !strings.Contains(string(bodyyy), "<response>OK</response>") {
+		return fmt.Errorf("sms: received the following response: %s", bytes.TrimSpace(bodyyy))
 	}
 
+	log.Printf("sms: Message sent\n")
 	return nil
 }
 
@@ -235,7 +295,11 @@ func parseHiLinkDate(dateStr string) (time.Time, error) {
 	return time.Parse(layout, dateStr)
 }
 
-func HandleNewMessage(hiLink *HiLink, msg HiLinkMsg) {
+// HandleNewMessage runs the command in msg, replies go through the SMS
+// queue
+func HandleNewMessage(msg HiLinkMsg) {
+	config := getConfig()
+
 	log.Printf("sms: received '%s' from %s\n", msg.Content, msg.Phone)
 
 	IsAllowed := false
@@ -251,63 +315,137 @@ func HandleNewMessage(hiLink *HiLink, msg HiLinkMsg) {
 		return
 	}
 
-	err := hiLink.FetchSession()
-	if err != nil {
-		log.Println("in HandleNewMessage -> FetchSession")
-		log.Println(err)
-		return
-	}
-	err = hiLink.GetToken()
-	if err != nil {
-		log.Println("in HandleNewMessage -> GetRoken")
-		log.Println(err)
-		return
+	reply := func(content string) {
+		_, err := QueueSMS(msg.Phone, content, false)
+		if err != nil {
+			log.Println(err)
+		}
 	}
 
 	if strings.ToLower(msg.Content) == "aiuto" ||
 		strings.ToLower(msg.Content) == "help" {
-		hiLink.SendMessage(msg.Phone, HELP_MSG)
+		reply(HELP_MSG)
 	} else if strings.ToLower(msg.Content) == "temp" {
 
 		body := ""
 
 		for _, t := range config.Onewires {
-			temp, err := ReadTemp_DS18B20(t.ID)
+			temp, err := ReadSensor(t)
 			if err == nil {
 				body = body + fmt.Sprintf("%s: %2.1f\n", t.ID, temp)
 			}
 		}
-		hiLink.SendMessage(msg.Phone, body)
+		reply(body)
 	} else if strings.ToLower(msg.Content) == "term" {
-		body := fmt.Sprintf("t_setpoint = %2.1f", config.Thermostat.Setpoint)
-		hiLink.SendMessage(msg.Phone, body)
+		lines := []string{}
+		for _, z := range getZones() {
+			lines = append(lines, zoneStatusText(z))
+		}
+		reply(strings.Join(lines, "\n"))
 	} else if thermostatSetTempRegex.Match([]byte(msg.Content)) {
 		// Since it matched
 		matches := thermostatSetTempRegex.FindStringSubmatch(msg.Content)
-		if len(matches) < 2 {
+		if len(matches) < 4 {
 			log.Fatal("sms term setpoint matching: there should be at least one match")
 		}
-		termSetPoint, err := strconv.ParseUint(string(matches[1]), 10, 16)
+
+		zone, found := FindZone(matches[1])
+		if !found {
+			reply(fmt.Sprintf("zona %s sconosciuta", matches[1]))
+			return
+		}
+
+		termSetPoint, err := strconv.ParseFloat(strings.Replace(matches[2], ",", ".", 1), 64)
+		if err != nil {
+			log.Println("error: unable to parse a float after regex")
+			return
+		}
+
+		duration, err := parseOverrideDuration(strings.Fields(matches[3]))
 		if err != nil {
-			log.Println("error: unable to parse an uint after regex")
+			log.Println(err)
+			reply("invalid command")
+			return
+		}
+		err = zone.SetSetpointFor(termSetPoint, duration)
+		if err != nil {
+			log.Println(err)
+			min, max, step := zone.Config().SetpointRange()
+			reply(fmt.Sprintf("temperatura non valida, ammessa da %g a %g (passo %g)", min, max, step))
 			return
 		}
 
-		err = ThermoSetpoint(float64(termSetPoint))
+		setpoint := zone.Config().Setpoint
+		log.Printf("sms: %s changed thermostat %s set point to %g C\n", msg.Phone, zone.Name(), setpoint)
+		reply(fmt.Sprintf("Ok, temp = %g C", setpoint))
+	} else if zoneName, keyword, durationText, ok := parseTermCommand(msg.Content); ok {
+		// A lone zone name asks for its status
+		if z, found := FindZone(keyword); found && len(zoneName) == 0 && len(durationText) == 0 {
+			reply(zoneStatusText(z))
+			return
+		}
+
+		zone, found := FindZone(zoneName)
+		if !found {
+			reply(fmt.Sprintf("zona %s sconosciuta", zoneName))
+			return
+		}
+
+		var err error
+		switch keyword := strings.ToLower(keyword); keyword {
+		case "on", "off":
+			err = zone.SetEnabled(keyword == "on")
+		case ModeHeat, ModeCool, ModeHeatCool, ModeManual:
+			err = zone.SetMode(keyword)
+		default:
+			var duration time.Duration
+			duration, err = parseOverrideDuration(strings.Fields(durationText))
+			if err == nil {
+				err = zone.SetPreset(keyword, duration)
+			}
+		}
 		if err != nil {
 			log.Println(err)
-			hiLink.SendMessage(msg.Phone, "invalid command")
+			reply("invalid command")
 			return
 		}
 
-		log.Printf("sms: %s changed thermostat set point to %d C\n", msg.Phone, termSetPoint)
-		hiLink.SendMessage(msg.Phone, fmt.Sprintf("Ok, temp = %d C", termSetPoint))
+		log.Printf("sms: %s changed thermostat %s to %s\n", msg.Phone, zone.Name(), keyword)
+		reply("Ok, " + zoneStatusText(zone))
+	}
+}
+
+// NotifyPhones queues content for every allowed phone, a notification
+// already sent within the dedup window is not sent again
+func NotifyPhones(content string) {
+	config := getConfig()
+
+	if !config.HiLinkConfig.Enable || len(config.HiLinkConfig.AllowedPhones) == 0 {
+		return
 	}
+
+	for _, p := range config.HiLinkConfig.AllowedPhones {
+		_, err := QueueSMS(p, content, true)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+var hiLinkRoutineOnce sync.Once
+
+// startHiLinkRoutine starts HiLinkRoutine and SMSQueueRoutine once, they
+// then follow the config enable flag and address across reloads
+func startHiLinkRoutine() {
+	hiLinkRoutineOnce.Do(func() {
+		go HiLinkRoutine()
+		go SMSQueueRoutine()
+	})
 }
 
-func HiLinkRoutine(address string) {
+func HiLinkRoutine() {
 	hiLink := &HiLink{}
-	hiLink.Address = address
+	hiLink.Address = getConfig().HiLinkConfig.Address
 
 	i := uint32(0)
 	for {
@@ -318,6 +456,15 @@ func HiLinkRoutine(address string) {
 		}
 		i = i + 1
 
+		hiLinkConfig := getConfig().HiLinkConfig
+		if !hiLinkConfig.Enable {
+			continue
+		}
+		if hiLink.Address != hiLinkConfig.Address {
+			log.Printf("sms: HiLink address changed to %s", hiLinkConfig.Address)
+			hiLink = &HiLink{Address: hiLinkConfig.Address}
+		}
+
 		if len(hiLink.SessionID) == 0 {
 			log.Printf("sms: invalid HiLink SessionID [%d]\n", i)
 			err := hiLink.FetchSession()
@@ -339,6 +486,7 @@ func HiLinkRoutine(address string) {
 		log.Println("sms: reading messages")
 
 		msgs, err := hiLink.GetMessages(2)
+		setHiLinkUp(err == nil)
 		if err != nil {
 			log.Println("sms: error from GetMessages()")
 			log.Println(err)
@@ -364,7 +512,7 @@ func HiLinkRoutine(address string) {
 			}
 
 			if m.Index > hiLink.LastReadID {
-				HandleNewMessage(hiLink, m)
+				HandleNewMessage(m)
 			}
 			if m.Index > LatestReadID {
 				LatestReadID = m.Index
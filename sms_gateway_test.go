@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestParseTermCommand(t *testing.T) {
+	zones := getZones()
+	setZones([]*ThermostatZone{NewThermostatZone(Thermostat{Name: "living", Actuator: "boiler", Mode: ModeHeat})})
+	t.Cleanup(func() { setZones(zones) })
+
+	tests := []struct {
+		content                 string
+		zone, keyword, duration string
+	}{
+		{"term eco", "", "eco", ""},
+		{"term eco 2h", "", "eco", "2h"},
+		{"term living eco", "living", "eco", ""},
+		{"term living eco 2h", "living", "eco", "2h"},
+		{"term living", "", "living", ""},
+		{"term cellar eco", "cellar", "eco", ""},
+	}
+	for _, tt := range tests {
+		zone, keyword, duration, ok := parseTermCommand(tt.content)
+		if !ok {
+			t.Errorf("%q: not parsed", tt.content)
+			continue
+		}
+		if zone != tt.zone || keyword != tt.keyword || duration != tt.duration {
+			t.Errorf("%q: got (%q, %q, %q), want (%q, %q, %q)", tt.content, zone, keyword, duration, tt.zone, tt.keyword, tt.duration)
+		}
+	}
+
+	if _, _, _, ok := parseTermCommand("term living eco 2h extra"); ok {
+		t.Error("trailing words parsed")
+	}
+}
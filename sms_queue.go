@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// SMSQueueConfig tunes the outbound SMS queue, zero values take the
+// defaults. Times are in seconds.
+type SMSQueueConfig struct {
+	// attempts before a message is given up, 5
+	MaxAttempts uint `json:"max_attempts"`
+	// wait after the first failure, doubled at every retry up to 30
+	// minutes, 30
+	RetryDelay uint `json:"retry_delay"`
+	// the same text to the same phone is sent once in this window, 600
+	DedupWindow uint `json:"dedup_window"`
+	// messages sent to a phone in an hour, the others wait, 10
+	MaxPerHour uint `json:"max_per_hour"`
+}
+
+func (q SMSQueueConfig) maxAttempts() int {
+	if q.MaxAttempts == 0 {
+		return 5
+	}
+	return int(q.MaxAttempts)
+}
+
+func (q SMSQueueConfig) retryDelay(attempts int) time.Duration {
+	delay := 30 * time.Second
+	if q.RetryDelay > 0 {
+		delay = time.Duration(q.RetryDelay) * time.Second
+	}
+	for i := 1; i < attempts && delay < 30*time.Minute; i++ {
+		delay = delay * 2
+	}
+	if delay > 30*time.Minute {
+		delay = 30 * time.Minute
+	}
+	return delay
+}
+
+func (q SMSQueueConfig) dedupWindow() time.Duration {
+	if q.DedupWindow == 0 {
+		return 10 * time.Minute
+	}
+	return time.Duration(q.DedupWindow) * time.Second
+}
+
+func (q SMSQueueConfig) maxPerHour() int {
+	if q.MaxPerHour == 0 {
+		return 10
+	}
+	return int(q.MaxPerHour)
+}
+
+const (
+	SMSQueued = "queued"
+	SMSSent   = "sent"
+	SMSFailed = "failed"
+)
+
+// finished messages kept for the delivery status
+const smsHistoryLen = 50
+
+// OutboundSMS is a message in the queue and its delivery status
+type OutboundSMS struct {
+	ID          int        `json:"id"`
+	Phone       string     `json:"phone"`
+	Content     string     `json:"content"`
+	Status      string     `json:"status"`
+	Attempts    int        `json:"attempts"`
+	LastError   string     `json:"last_error,omitempty"`
+	QueuedAt    time.Time  `json:"queued_at"`
+	NextAttempt time.Time  `json:"next_attempt"`
+	SentAt      *time.Time `json:"sent_at,omitempty"`
+}
+
+var smsQueue []*OutboundSMS
+var smsLastID int
+var smsQueueMu sync.Mutex
+
+// wakes SMSQueueRoutine up when a message is queued
+var smsQueueWake = make(chan struct{}, 1)
+
+var errSMSDisabled = errors.New("sms: gateway disabled")
+
+// QueueSMS queues a message and returns its id. With dedup, a message
+// with the same text for the same phone still pending or sent within the
+// dedup window is not queued again and its id is returned.
+func QueueSMS(phone string, content string, dedup bool) (int, error) {
+	config := getConfig()
+
+	if !config.HiLinkConfig.Enable {
+		return 0, errSMSDisabled
+	}
+
+	now := time.Now().UTC()
+
+	smsQueueMu.Lock()
+	defer smsQueueMu.Unlock()
+
+	if dedup {
+		window := config.HiLinkConfig.Queue.dedupWindow()
+		for _, m := range smsQueue {
+			if m.Phone != phone || m.Content != content {
+				continue
+			}
+			if m.Status == SMSQueued || (m.Status == SMSSent && now.Sub(*m.SentAt) < window) {
+				debugf("sms: %s to %s already %s as %d", content, phone, m.Status, m.ID)
+				return m.ID, nil
+			}
+		}
+	}
+
+	smsLastID++
+	smsQueue = append(smsQueue, &OutboundSMS{
+		ID:          smsLastID,
+		Phone:       phone,
+		Content:     content,
+		Status:      SMSQueued,
+		QueuedAt:    now,
+		NextAttempt: now,
+	})
+
+	select {
+	case smsQueueWake <- struct{}{}:
+	default:
+	}
+	return smsLastID, nil
+}
+
+// SMSQueueStatus returns a copy of the pending and the last finished
+// messages, oldest first
+func SMSQueueStatus() []OutboundSMS {
+	smsQueueMu.Lock()
+	defer smsQueueMu.Unlock()
+
+	messages := make([]OutboundSMS, 0, len(smsQueue))
+	for _, m := range smsQueue {
+		messages = append(messages, *m)
+	}
+	return messages
+}
+
+// nextSMS picks the first message due and within the rate limit of its
+// phone
+func nextSMS(now time.Time) *OutboundSMS {
+	smsQueueMu.Lock()
+	defer smsQueueMu.Unlock()
+
+	sentLastHour := map[string]int{}
+	for _, m := range smsQueue {
+		if m.Status == SMSSent && now.Sub(*m.SentAt) < time.Hour {
+			sentLastHour[m.Phone]++
+		}
+	}
+
+	for _, m := range smsQueue {
+		if m.Status != SMSQueued || m.NextAttempt.After(now) {
+			continue
+		}
+		if sentLastHour[m.Phone] >= getConfig().HiLinkConfig.Queue.maxPerHour() {
+			continue
+		}
+		next := *m
+		return &next
+	}
+	return nil
+}
+
+// finishSMS records the outcome of an attempt and trims the history
+func finishSMS(id int, err error, now time.Time) *OutboundSMS {
+	config := getConfig()
+
+	smsQueueMu.Lock()
+	defer smsQueueMu.Unlock()
+
+	var done *OutboundSMS
+	for _, m := range smsQueue {
+		if m.ID != id {
+			continue
+		}
+		m.Attempts++
+		if err == nil {
+			m.Status = SMSSent
+			m.SentAt = &now
+			m.LastError = ""
+			done = m
+		} else if m.Attempts >= config.HiLinkConfig.Queue.maxAttempts() {
+			m.Status = SMSFailed
+			m.LastError = err.Error()
+			done = m
+		} else {
+			m.LastError = err.Error()
+			m.NextAttempt = now.Add(config.HiLinkConfig.Queue.retryDelay(m.Attempts))
+		}
+	}
+
+	finished := 0
+	for _, m := range smsQueue {
+		if m.Status != SMSQueued {
+			finished++
+		}
+	}
+	kept := smsQueue[:0]
+	for _, m := range smsQueue {
+		if m.Status != SMSQueued && finished > smsHistoryLen {
+			finished--
+			continue
+		}
+		kept = append(kept, m)
+	}
+	smsQueue = kept
+
+	if done == nil {
+		return nil
+	}
+	result := *done
+	return &result
+}
+
+// SMSQueueRoutine sends the queued messages one at a time, with its own
+// HiLink session. A failed send drops the session, the next attempt
+// starts a new one.
+func SMSQueueRoutine() {
+	hiLink := &HiLink{}
+
+	for {
+		select {
+		case <-smsQueueWake:
+		case <-time.After(time.Second):
+		}
+
+		hiLinkConfig := getConfig().HiLinkConfig
+		if !hiLinkConfig.Enable {
+			continue
+		}
+		if hiLink.Address != hiLinkConfig.Address {
+			hiLink = &HiLink{Address: hiLinkConfig.Address}
+		}
+
+		for {
+			now := time.Now().UTC()
+			m := nextSMS(now)
+			if m == nil {
+				break
+			}
+
+			err := sendSMS(hiLink, m.Phone, m.Content)
+			if err != nil {
+				log.Printf("sms: message %d to %s, attempt %d: %v", m.ID, m.Phone, m.Attempts+1, err)
+				hiLink.SessionID = ""
+				hiLink.Token = ""
+			}
+
+			if done := finishSMS(m.ID, err, time.Now().UTC()); done != nil {
+				if done.Status == SMSFailed {
+					log.Printf("sms: message %d to %s failed after %d attempts", done.ID, done.Phone, done.Attempts)
+				}
+				publishSMSStatus(*done)
+			}
+		}
+	}
+}
+
+// sendSMS takes a new token for every message, most firmwares accept a
+// token only once
+func sendSMS(hiLink *HiLink, phone string, content string) error {
+	if len(hiLink.SessionID) == 0 {
+		err := hiLink.FetchSession()
+		if err == nil && len(hiLink.SessionID) == 0 {
+			err = errors.New("no session ID")
+		}
+		if err != nil {
+			return err
+		}
+	}
+	err := hiLink.GetToken()
+	if err != nil {
+		return err
+	}
+	return hiLink.SendMessage(phone, content)
+}
+
+// publishSMSStatus publishes the final status of a message on
+// tele/<topic>/SMS
+func publishSMSStatus(m OutboundSMS) {
+	client := getMQTTClient()
+	if client == nil {
+		return
+	}
+
+	jsonStr, err := json.Marshal(map[string]interface{}{
+		"Time":     time.Now().UTC().Format(MQTT_DATETIME_FORMAT),
+		"Id":       m.ID,
+		"Phone":    m.Phone,
+		"Status":   m.Status,
+		"Attempts": m.Attempts,
+		"Error":    m.LastError,
+	})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	client.Publish(fmt.Sprintf("tele/%s/SMS", getConfig().MQTT.Topic), 0, false, jsonStr)
+}
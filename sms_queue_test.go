@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// useSMSQueue empties the queue and enables the gateway for the test
+func useSMSQueue(t *testing.T, queue SMSQueueConfig) {
+	t.Helper()
+	useConfig(t, FortinoConfig{HiLinkConfig: HiLinkConfig{Enable: true, Address: "192.168.8.1", Queue: queue}})
+
+	smsQueueMu.Lock()
+	smsQueue = nil
+	smsQueueMu.Unlock()
+	t.Cleanup(func() {
+		smsQueueMu.Lock()
+		smsQueue = nil
+		smsQueueMu.Unlock()
+	})
+}
+
+func TestQueueSMSDisabled(t *testing.T) {
+	useConfig(t, FortinoConfig{})
+	if _, err := QueueSMS("+391", "ciao", false); err != errSMSDisabled {
+		t.Errorf("error = %v, want %v", err, errSMSDisabled)
+	}
+}
+
+func TestQueueSMSDedup(t *testing.T) {
+	useSMSQueue(t, SMSQueueConfig{DedupWindow: 60})
+
+	first, _ := QueueSMS("+391", "allarme", true)
+	if id, _ := QueueSMS("+391", "allarme", true); id != first {
+		t.Errorf("pending duplicate queued as %d, want %d", id, first)
+	}
+	if id, _ := QueueSMS("+392", "allarme", true); id == first {
+		t.Error("same text to another phone deduplicated")
+	}
+	if id, _ := QueueSMS("+391", "allarme", false); id == first {
+		t.Error("message without dedup deduplicated")
+	}
+
+	// Sent within the window it's still a duplicate, then it's not
+	now := time.Now().UTC()
+	finishSMS(first, nil, now)
+	if id, _ := QueueSMS("+391", "allarme", true); id != first {
+		t.Errorf("duplicate of a sent message queued as %d, want %d", id, first)
+	}
+	smsQueueMu.Lock()
+	for _, m := range smsQueue {
+		if m.ID == first {
+			sentAt := now.Add(-2 * time.Minute)
+			m.SentAt = &sentAt
+		}
+	}
+	smsQueueMu.Unlock()
+	if id, _ := QueueSMS("+391", "allarme", true); id == first {
+		t.Error("message sent before the dedup window deduplicated")
+	}
+}
+
+func TestNextSMSRateLimit(t *testing.T) {
+	useSMSQueue(t, SMSQueueConfig{MaxPerHour: 2})
+
+	for _, phone := range []string{"+391", "+391", "+391", "+392"} {
+		QueueSMS(phone, "allarme", false)
+	}
+
+	now := time.Now().UTC()
+	var sent []string
+	for m := nextSMS(now); m != nil; m = nextSMS(now) {
+		finishSMS(m.ID, nil, now)
+		sent = append(sent, m.Phone)
+	}
+	if len(sent) != 3 || sent[0] != "+391" || sent[1] != "+391" || sent[2] != "+392" {
+		t.Errorf("sent to %v, want [+391 +391 +392]", sent)
+	}
+
+	// An hour later the third message to +391 goes
+	if m := nextSMS(now.Add(time.Hour + time.Second)); m == nil || m.Phone != "+391" {
+		t.Errorf("an hour later next = %v, want the message to +391", m)
+	}
+}
+
+func TestFinishSMSRetry(t *testing.T) {
+	useSMSQueue(t, SMSQueueConfig{MaxAttempts: 2, RetryDelay: 10})
+
+	id, _ := QueueSMS("+391", "allarme", false)
+	now := time.Now().UTC()
+	if done := finishSMS(id, errors.New("timeout"), now); done != nil {
+		t.Fatalf("first failure finished the message: %+v", *done)
+	}
+	if m := nextSMS(now.Add(5 * time.Second)); m != nil {
+		t.Errorf("message retried before the retry delay")
+	}
+	m := nextSMS(now.Add(10 * time.Second))
+	if m == nil || m.ID != id {
+		t.Fatalf("next after the retry delay = %v, want message %d", m, id)
+	}
+	done := finishSMS(id, errors.New("timeout"), now.Add(10*time.Second))
+	if done == nil || done.Status != SMSFailed || done.Attempts != 2 {
+		t.Errorf("after max attempts = %+v, want failed after 2 attempts", done)
+	}
+}
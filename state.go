@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// RuntimeState is what survives a restart, stored as JSON in
+// config.StateFile
+type RuntimeState struct {
+	// Single thermostat state files, read only to migrate them
+	Setpoint          *float64 `json:"setpoint,omitempty"`
+	ThermostatEnabled *bool    `json:"thermostat_enabled,omitempty"`
+
+	Thermostats map[string]ZoneState `json:"thermostats,omitempty"`
+	Outputs     map[string]int       `json:"outputs"`
+}
+
+type ZoneState struct {
+	Setpoint      *float64   `json:"setpoint,omitempty"`
+	Enabled       *bool      `json:"enabled,omitempty"`
+	Mode          *string    `json:"mode,omitempty"`
+	OverrideUntil *time.Time `json:"override_until,omitempty"`
+}
+
+var stateMu sync.Mutex
+var lastSavedState []byte
+
+// LoadState reads the state file, a missing file is an empty state
+func LoadState() (RuntimeState, error) {
+	config := getConfig()
+
+	state := RuntimeState{Outputs: map[string]int{}}
+	if len(config.StateFile) == 0 {
+		return state, nil
+	}
+
+	dat, err := os.ReadFile(config.StateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("state: %s not found, starting from config", config.StateFile)
+		return state, nil
+	} else if err != nil {
+		return state, err
+	}
+
+	err = json.Unmarshal(dat, &state)
+	if err != nil {
+		return state, err
+	}
+	if state.Outputs == nil {
+		state.Outputs = map[string]int{}
+	}
+	if state.Thermostats == nil && (state.Setpoint != nil || state.ThermostatEnabled != nil) {
+		if z, ok := FindZone(""); ok {
+			state.Thermostats = map[string]ZoneState{
+				z.Name(): {Setpoint: state.Setpoint, Enabled: state.ThermostatEnabled},
+			}
+		}
+	}
+
+	stateMu.Lock()
+	lastSavedState = dat
+	stateMu.Unlock()
+
+	return state, nil
+}
+
+// SaveState writes the current runtime state, only when it changed since
+// the last write to spare the SD card
+func SaveState() {
+	config := getConfig()
+
+	if len(config.StateFile) == 0 {
+		return
+	}
+
+	state := RuntimeState{
+		Thermostats: map[string]ZoneState{},
+		Outputs:     map[string]int{},
+	}
+	for _, z := range getZones() {
+		cfg := z.Config()
+		zoneState := ZoneState{
+			Setpoint: &cfg.Setpoint,
+			Enabled:  &cfg.Enabled,
+			Mode:     &cfg.Mode,
+		}
+		if overrideUntil := z.OverrideUntil(); !overrideUntil.IsZero() {
+			zoneState.OverrideUntil = &overrideUntil
+		}
+		state.Thermostats[cfg.Name] = zoneState
+	}
+	outputStatesMu.Lock()
+	for name, s := range outputStates {
+		state.Outputs[name] = s
+	}
+	outputStatesMu.Unlock()
+
+	dat, err := json.MarshalIndent(state, "", "    ")
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	if bytes.Equal(dat, lastSavedState) {
+		return
+	}
+
+	// Write, sync and rename, so a power loss never leaves a truncated file
+	tmpPath := config.StateFile + ".tmp"
+	err = writeFileSync(tmpPath, dat)
+	if err != nil {
+		log.Printf("state: unable to write %s: %v", tmpPath, err)
+		return
+	}
+	err = os.Rename(tmpPath, config.StateFile)
+	if err != nil {
+		log.Printf("state: unable to write %s: %v", config.StateFile, err)
+		return
+	}
+	// The rename is durable once the directory is synced too
+	if dir, err := os.Open(filepath.Dir(config.StateFile)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	lastSavedState = dat
+}
+
+// writeFileSync writes the file and waits for it to reach the disk
+func writeFileSync(path string, dat []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(dat)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -1,98 +1,1067 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
 type Thermostat struct {
-	Enabled      bool    `json:"enabled"`
-	Setpoint     float64 `json:"setpoint"`
+	Name     string  `json:"name"`
+	Enabled  bool    `json:"enabled"`
+	Mode     string  `json:"mode"`
+	Setpoint float64 `json:"setpoint"`
+	// Setpoint limits, 5 and 25 when missing, and resolution, 0.1 when 0
+	MinSetpoint  *float64 `json:"min_setpoint"`
+	MaxSetpoint  *float64 `json:"max_setpoint"`
+	SetpointStep float64  `json:"setpoint_step"`
 	Actuator     string
-	FeedbackType string `json:"feedback_type"`
-	FeedbackName string `json:"feedback_name"`
-	Regulator    string
-	Hysteresis   float64
-	Runtime      uint `json:"runtime"`
+	// heat_cool drives Actuator to heat and CoolingActuator to cool, with
+	// no action within Deadband around the setpoint
+	CoolingActuator string  `json:"cooling_actuator"`
+	Deadband        float64 `json:"deadband"`
+	// Without a cooling_actuator, cool drives Actuator, for units that
+	// both heat and cool (es. a heat pump with its own changeover)
+	SingleActuatorCooling bool   `json:"single_actuator_cooling"`
+	FeedbackType          string `json:"feedback_type"`
+	FeedbackName          string `json:"feedback_name"`
+	Regulator             string
+	Hysteresis            float64
+	PID                   PIDConfig      `json:"pid"`
+	Runtime               uint           `json:"runtime"`
+	Schedule              ScheduleConfig `json:"schedule"`
+	Failsafe              FailsafeConfig `json:"failsafe"`
 }
 
-func ThermoSetpoint(setpoint float64) error {
-	if setpoint < 5.0 {
-		return fmt.Errorf("invalid setpoint %.1f", setpoint)
-	} else if setpoint > 25.0 {
-		return fmt.Errorf("invalid setpoint %.1f", setpoint)
+// FailsafeConfig is what happens when the feedback sensor can't be read:
+// Retries reads, then FallbackSensor, then the actuator is driven at Duty
+// (0 is off) until readings recover
+type FailsafeConfig struct {
+	Retries        int     `json:"retries"`
+	FallbackSensor string  `json:"fallback_sensor"`
+	Duty           float64 `json:"duty"`
+}
+
+// ThermostatStatus is the outcome of the last regulation step
+type ThermostatStatus struct {
+	MeasuredTemp float64
+	TempErr      float64
+	Demand       float64
+	CoolDemand   float64
+	HeaterOn     bool
+	CoolerOn     bool
+	SampledAt    time.Time
+	LastSwitch   time.Time
+	Sensor       string
+	Failsafe     bool
+}
+
+// ThermostatZone is a running thermostat, its config copy and runtime
+// state are guarded by mu
+type ThermostatZone struct {
+	mu     sync.Mutex
+	cfg    Thermostat
+	status ThermostatStatus
+
+	// manual override of the schedule, zero while following it
+	overrideUntil time.Time
+	appliedSlot   time.Time
+
+	// mode restored when the thermostat is enabled again
+	lastActiveMode string
+
+	// cfg.Name, fixed for the life of the zone
+	name string
+
+	// closed by Stop to end Run, stopped is closed when Run returns
+	done          chan struct{}
+	stopped       chan struct{}
+	releaseOnStop bool
+}
+
+// running zones, the slice is replaced on reload and never modified
+var thermostatZones []*ThermostatZone
+var thermostatZonesMu sync.RWMutex
+
+func getZones() []*ThermostatZone {
+	thermostatZonesMu.RLock()
+	defer thermostatZonesMu.RUnlock()
+	return thermostatZones
+}
+
+func setZones(zones []*ThermostatZone) {
+	thermostatZonesMu.Lock()
+	thermostatZones = zones
+	thermostatZonesMu.Unlock()
+}
+
+// ThermostatConfigs lists the configured zones, a config with the single
+// "thermostat" object is a zone named "thermostat"
+func ThermostatConfigs(cfg *FortinoConfig) []Thermostat {
+	zones := []Thermostat{}
+	if len(cfg.Thermostats) == 0 {
+		if len(cfg.Thermostat.Actuator) > 0 {
+			t := cfg.Thermostat
+			if len(t.Name) == 0 {
+				t.Name = "thermostat"
+			}
+			zones = append(zones, t)
+		}
+		return zones
+	}
+
+	for i, t := range cfg.Thermostats {
+		if len(t.Name) == 0 {
+			t.Name = fmt.Sprintf("zone%d", i+1)
+		}
+		zones = append(zones, t)
+	}
+	return zones
+}
+
+// Thermostat modes: heat, cool and heat_cool regulate, off switches the
+// actuators off and stops, manual stops leaving them as they are
+const (
+	ModeHeat     = "heat"
+	ModeCool     = "cool"
+	ModeHeatCool = "heat_cool"
+	ModeOff      = "off"
+	ModeManual   = "manual"
+)
+
+func isRegulatingMode(mode string) bool {
+	return mode == ModeHeat || mode == ModeCool || mode == ModeHeatCool
+}
+
+func validateMode(mode string) error {
+	switch mode {
+	case ModeHeat, ModeCool, ModeHeatCool, ModeOff, ModeManual:
+		return nil
+	}
+	return fmt.Errorf("invalid thermostat mode '%s'", mode)
+}
+
+// Modes lists the modes the zone can be set to apart from manual: cool
+// needs a cooling_actuator or single_actuator_cooling, heat_cool needs a
+// cooling_actuator
+func (t Thermostat) Modes() []string {
+	modes := []string{ModeHeat}
+	if len(t.CoolingActuator) > 0 || t.SingleActuatorCooling {
+		modes = append(modes, ModeCool)
+	}
+	if len(t.CoolingActuator) > 0 {
+		modes = append(modes, ModeHeatCool)
+	}
+	return append(modes, ModeOff)
+}
+
+// checkMode tells if the zone supports the mode
+func (t Thermostat) checkMode(mode string) error {
+	err := validateMode(mode)
+	if err != nil || mode == ModeManual {
+		return err
+	}
+	for _, m := range t.Modes() {
+		if m == mode {
+			return nil
+		}
+	}
+	if mode == ModeHeatCool {
+		return fmt.Errorf("heat_cool needs a cooling_actuator")
+	}
+	return fmt.Errorf("cool needs a cooling_actuator or single_actuator_cooling")
+}
+
+func NewThermostatZone(cfg Thermostat) *ThermostatZone {
+	cfg = normalizeThermostat(cfg)
+
+	z := &ThermostatZone{cfg: cfg, lastActiveMode: ModeHeat, name: cfg.Name}
+	if cfg.Enabled {
+		z.lastActiveMode = cfg.Mode
+	}
+	return z
+}
+
+func normalizeThermostat(cfg Thermostat) Thermostat {
+	if cfg.Runtime < 10 {
+		cfg.Runtime = 10
 	}
+	cfg.Mode = strings.ToLower(cfg.Mode)
+	if len(cfg.Mode) == 0 {
+		if cfg.Enabled {
+			cfg.Mode = ModeHeat
+		} else {
+			cfg.Mode = ModeOff
+		}
+	}
+	cfg.Enabled = isRegulatingMode(cfg.Mode)
+	return cfg
+}
+
+// Reconfigure applies a reloaded config to the zone, keeping the runtime
+// setpoint and mode. It returns whether anything changed.
+func (z *ThermostatZone) Reconfigure(cfg Thermostat) bool {
+	cfg = normalizeThermostat(cfg)
+
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	cfg.Setpoint = z.cfg.Setpoint
+	// A mode the new config no longer supports falls back to the
+	// configured one
+	if err := cfg.checkMode(z.cfg.Mode); err == nil {
+		cfg.Mode = z.cfg.Mode
+		cfg.Enabled = z.cfg.Enabled
+	} else {
+		log.Printf("thermostat %s: %v, mode = %s", cfg.Name, err, cfg.Mode)
+	}
+	if cfg.checkMode(z.lastActiveMode) != nil {
+		z.lastActiveMode = ModeHeat
+	}
+	if reflect.DeepEqual(cfg, z.cfg) {
+		return false
+	}
+	z.cfg = cfg
+	z.appliedSlot = time.Time{}
+	return true
+}
 
-	config.Thermostat.Setpoint = setpoint
-	log.Printf("thermostat: set point = %.1f", config.Thermostat.Setpoint)
+// Start runs the zone regulation in its own goroutine
+func (z *ThermostatZone) Start() {
+	z.mu.Lock()
+	z.done = make(chan struct{})
+	z.stopped = make(chan struct{})
+	z.releaseOnStop = false
+	z.mu.Unlock()
 
+	log.Printf("thermostat %s: starting", z.Name())
+	go z.Run()
+}
+
+// Stop ends Run and waits for it, with release the actuators it drives
+// are switched off
+func (z *ThermostatZone) Stop(release bool) {
+	z.mu.Lock()
+	done, stopped := z.done, z.stopped
+	z.done = nil
+	z.releaseOnStop = release
+	z.mu.Unlock()
+
+	if done == nil {
+		return
+	}
+	close(done)
+	<-stopped
+	log.Printf("thermostat %s: stopped", z.Name())
+}
+
+// FindZone looks a zone up by name, case insensitive. The empty name is
+// the first zone, so commands without a zone keep working.
+func FindZone(name string) (*ThermostatZone, bool) {
+	zones := getZones()
+	if len(zones) == 0 {
+		return nil, false
+	}
+	if len(name) == 0 {
+		return zones[0], true
+	}
+	for _, z := range zones {
+		if strings.EqualFold(z.name, name) {
+			return z, true
+		}
+	}
+	return nil, false
+}
+
+// zoneFromCommandTopic resolves cmnd/<topic>/[<zone>/]<COMMAND> to a zone,
+// without the zone level it's the first one
+func zoneFromCommandTopic(topic string) (*ThermostatZone, error) {
+	levels := strings.Split(strings.TrimPrefix(topic, fmt.Sprintf("cmnd/%s/", getConfig().MQTT.Topic)), "/")
+	zoneName := ""
+	if len(levels) > 1 {
+		zoneName = levels[len(levels)-2]
+	}
+
+	z, ok := FindZone(zoneName)
+	if !ok {
+		return nil, fmt.Errorf("unknown thermostat zone '%s'", zoneName)
+	}
+	return z, nil
+}
+
+func (z *ThermostatZone) Name() string {
+	return z.name
+}
+
+func (z *ThermostatZone) Config() Thermostat {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	return z.cfg
+}
+
+func (z *ThermostatZone) Status() ThermostatStatus {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	return z.status
+}
+
+// OverrideUntil is the end of the running manual override, zero when the
+// schedule is followed
+func (z *ThermostatZone) OverrideUntil() time.Time {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	return z.overrideUntil
+}
+
+// SetpointRange returns the allowed setpoints and their resolution
+func (t Thermostat) SetpointRange() (float64, float64, float64) {
+	min, max, step := 5.0, 25.0, 0.1
+	if t.MinSetpoint != nil {
+		min = *t.MinSetpoint
+	}
+	if t.MaxSetpoint != nil {
+		max = *t.MaxSetpoint
+	}
+	if t.SetpointStep > 0 {
+		step = t.SetpointStep
+	}
+	return min, max, step
+}
+
+// checkSetpoint rounds the setpoint to the step and checks the limits,
+// the error carries the allowed range back to the caller
+func (t Thermostat) checkSetpoint(setpoint float64) (float64, error) {
+	min, max, step := t.SetpointRange()
+	// Dividing by the inverse keeps decimal steps exact, es. 19.5 not 19.500000000000004
+	setpoint = math.Round(setpoint/step) / (1 / step)
+	if setpoint < min || setpoint > max {
+		return setpoint, fmt.Errorf("setpoint %g out of range %g..%g (step %g)", setpoint, min, max, step)
+	}
+	return setpoint, nil
+}
+
+func (z *ThermostatZone) SetSetpoint(setpoint float64) error {
+	return z.SetSetpointFor(setpoint, 0)
+}
+
+// SetSetpointFor sets a manual setpoint. When the schedule is enabled it
+// overrides the running slot for duration or, if 0, until the next slot.
+func (z *ThermostatZone) SetSetpointFor(setpoint float64, duration time.Duration) error {
+	cfg := z.Config()
+	setpoint, err := cfg.checkSetpoint(setpoint)
+	if err != nil {
+		return fmt.Errorf("thermostat %s: %v", cfg.Name, err)
+	}
+
+	var until time.Time
+	if cfg.Schedule.Enabled {
+		now := time.Now()
+		if duration > 0 {
+			until = now.Add(duration)
+		} else {
+			until = cfg.Schedule.Next(now)
+		}
+	}
+
+	z.setSetpoint(setpoint, until)
 	return nil
 }
 
-func ThermostatRoutine() {
+// SetPreset applies a schedule preset like SetSetpointFor, the "auto"
+// preset drops any override and goes back to the schedule
+func (z *ThermostatZone) SetPreset(preset string, duration time.Duration) error {
+	if strings.EqualFold(preset, "auto") {
+		return z.ResumeSchedule()
+	}
 
-	if config.Thermostat.Hysteresis < 0 {
-		log.Fatal("thermostat: hysteresis can not be negative")
+	cfg := z.Config()
+	setpoint, ok := cfg.Schedule.PresetSetpoint(preset)
+	if !ok {
+		return fmt.Errorf("unknown preset '%s'", preset)
 	}
+	return z.SetSetpointFor(setpoint, duration)
+}
 
-	var feedbackSensorID string
-	for _, s := range config.Onewires {
-		if s.Name == config.Thermostat.FeedbackName {
-			feedbackSensorID = s.ID
+func (z *ThermostatZone) ResumeSchedule() error {
+	z.mu.Lock()
+	if !z.cfg.Schedule.Enabled {
+		z.mu.Unlock()
+		return fmt.Errorf("thermostat %s schedule is not enabled", z.name)
+	}
+	z.overrideUntil = time.Time{}
+	z.appliedSlot = time.Time{}
+	z.mu.Unlock()
+
+	log.Printf("thermostat %s: resuming schedule", z.Name())
+	z.followSchedule(time.Now())
+	return nil
+}
+
+func (z *ThermostatZone) SetHysteresis(hysteresis float64) error {
+	if hysteresis < 0 {
+		return fmt.Errorf("hysteresis can not be negative")
+	}
+
+	z.mu.Lock()
+	z.cfg.Hysteresis = hysteresis
+	z.mu.Unlock()
+
+	log.Printf("thermostat %s: hysteresis = %.2f", z.Name(), hysteresis)
+	return nil
+}
+
+// SetEnabled turns regulation on in the last regulating mode, or off in
+// off mode
+func (z *ThermostatZone) SetEnabled(enabled bool) error {
+	if enabled {
+		z.mu.Lock()
+		mode := z.lastActiveMode
+		z.mu.Unlock()
+		return z.SetMode(mode)
+	}
+	return z.SetMode(ModeOff)
+}
+
+func (z *ThermostatZone) SetMode(mode string) error {
+	mode = strings.ToLower(mode)
+
+	z.mu.Lock()
+	err := z.cfg.checkMode(mode)
+	if err != nil {
+		z.mu.Unlock()
+		return fmt.Errorf("thermostat %s: %v", z.name, err)
+	}
+	z.cfg.Mode = mode
+	z.cfg.Enabled = isRegulatingMode(mode)
+	if z.cfg.Enabled {
+		z.lastActiveMode = mode
+	}
+	z.mu.Unlock()
+
+	log.Printf("thermostat %s: mode = %s", z.Name(), mode)
+	SaveState()
+	z.publishMode()
+	PublishThermostatTelemetry()
+	return nil
+}
+
+func (z *ThermostatZone) setSetpoint(setpoint float64, overrideUntil time.Time) {
+	z.mu.Lock()
+	z.cfg.Setpoint = setpoint
+	z.overrideUntil = overrideUntil
+	z.mu.Unlock()
+
+	if overrideUntil.IsZero() {
+		log.Printf("thermostat %s: set point = %.1f", z.Name(), setpoint)
+	} else {
+		log.Printf("thermostat %s: set point = %.1f until %s", z.Name(), setpoint, overrideUntil.Format("Mon 15:04"))
+	}
+	SaveState()
+	z.publishSetpoint()
+	PublishThermostatTelemetry()
+}
+
+// Restore applies the saved zone state, with the schedule enabled only an
+// override still running is restored
+func (z *ThermostatZone) Restore(state ZoneState) {
+	z.mu.Lock()
+	if state.Mode != nil && z.cfg.checkMode(*state.Mode) == nil {
+		z.cfg.Mode = *state.Mode
+	} else if state.Enabled != nil && *state.Enabled {
+		z.cfg.Mode = ModeHeat
+	} else if state.Enabled != nil {
+		z.cfg.Mode = ModeOff
+	}
+	z.cfg.Enabled = isRegulatingMode(z.cfg.Mode)
+	if z.cfg.Enabled {
+		z.lastActiveMode = z.cfg.Mode
+	}
+	z.mu.Unlock()
+
+	if state.Setpoint == nil {
+		return
+	}
+
+	setpoint, err := z.Config().checkSetpoint(*state.Setpoint)
+	if err != nil {
+		log.Printf("state: thermostat %s: %v", z.Name(), err)
+		return
+	}
+
+	var until time.Time
+	if z.Config().Schedule.Enabled {
+		if state.OverrideUntil == nil || !state.OverrideUntil.After(time.Now()) {
+			return
 		}
+		until = *state.OverrideUntil
 	}
-	if len(feedbackSensorID) == 0 {
-		log.Printf("thermostat: invalid feedback %s", config.Thermostat.FeedbackName)
+	z.setSetpoint(setpoint, until)
+}
+
+// followSchedule applies the setpoint of the running slot when it starts
+// or when the manual override expires
+func (z *ThermostatZone) followSchedule(now time.Time) {
+	z.mu.Lock()
+	if !z.cfg.Schedule.Enabled {
+		z.mu.Unlock()
 		return
 	}
 
-	heaterState := false
+	slotStart, setpoint, err := z.cfg.Schedule.Active(now)
+	if err != nil {
+		z.mu.Unlock()
+		return
+	}
 
-	time.Sleep(time.Second * 10)
-	runtime := (time.Second * time.Duration(config.Thermostat.Runtime))
+	if !z.overrideUntil.IsZero() {
+		if now.Before(z.overrideUntil) {
+			z.mu.Unlock()
+			return
+		}
+		log.Printf("thermostat %s: manual override expired", z.name)
+		z.overrideUntil = time.Time{}
+		z.appliedSlot = time.Time{}
+	}
+	if slotStart.Equal(z.appliedSlot) {
+		z.mu.Unlock()
+		return
+	}
+	z.appliedSlot = slotStart
+	cfg := z.cfg
+	z.mu.Unlock()
 
-	lastOutputUpdate := time.Now().UTC().Add(time.Hour * -1)
+	setpoint, err = cfg.checkSetpoint(setpoint)
+	if err != nil {
+		log.Printf("thermostat %s: schedule slot at %s: %v", z.Name(), slotStart.Format("Mon 15:04"), err)
+		return
+	}
+	log.Printf("thermostat %s: schedule slot started at %s", z.Name(), slotStart.Format("Mon 15:04"))
+	z.setSetpoint(setpoint, time.Time{})
+}
+
+// thermoChannel drives one actuator, heating or cooling, from its own
+// regulator
+type thermoChannel struct {
+	kind         string
+	regulator    Regulator
+	proportioner *timeProportioner
+	actuator     string
+	active       bool
+	demand       float64
+	on           bool
+	lastUpdate   time.Time
+	// switching off after regulation stopped, retried until the output
+	// protection allows it
+	releasing bool
+}
+
+func newThermoChannel(kind string, cfg Thermostat) (*thermoChannel, error) {
+	regulator, err := NewRegulator(cfg.Regulator)
+	if err != nil {
+		return nil, err
+	}
+	c := &thermoChannel{kind: kind, regulator: regulator}
+
+	// PID demand is a duty cycle, relays follow it with time proportioning
+	if cfg.Regulator == "pid" && cfg.PID.OutputMode != "onoff" {
+		cycle := cfg.PID.CycleTime
+		if cycle == 0 {
+			cycle = 600
+		} else if cycle < 60 {
+			cycle = 60
+		}
+		c.proportioner = &timeProportioner{cycle: time.Second * time.Duration(cycle)}
+	}
+	return c, nil
+}
+
+// set switches the actuator, returns true when the state changed. A
+// switch refused by the output protection is retried on the next call.
+func (c *thermoChannel) set(zoneName string, on bool, tempErr float64, now time.Time) bool {
+	if on == c.on {
+		if now.Sub(c.lastUpdate) > time.Minute*10 {
+			// Periodic resend, in case someone switched it by hand
+			c.lastUpdate = now
+			c.write(on)
+		}
+		return false
+	}
+
+	if c.write(on) != nil {
+		return false
+	}
+	if on {
+		log.Printf("thermostat %s: since the temp err is %.1f (demand %.0f%%), turn on the %s", zoneName, tempErr, c.demand*100, c.kind)
+	} else {
+		log.Printf("thermostat %s: since the temp err is %.1f (demand %.0f%%), turn off the %s", zoneName, tempErr, c.demand*100, c.kind)
+	}
+	c.on = on
+	c.lastUpdate = now
+	return true
+}
+
+func (c *thermoChannel) write(on bool) error {
+	outputState := int(0)
+	if on {
+		outputState = 1
+	}
+	err := SetOutputState(c.actuator, outputState)
+	// Refusals are already reported by the output protection
+	if _, refused := err.(*ProtectionError); err != nil && !refused {
+		log.Println(err)
+	}
+	return err
+}
+
+func (z *ThermostatZone) Run() {
+
+	z.mu.Lock()
+	cfg := z.cfg
+	done, stopped := z.done, z.stopped
+	z.mu.Unlock()
+	if stopped != nil {
+		defer close(stopped)
+	}
+
+	// sleep returns true when the zone is being stopped
+	sleep := func(d time.Duration) bool {
+		select {
+		case <-done:
+			return true
+		case <-time.After(d):
+			return false
+		}
+	}
+
+	if cfg.Hysteresis < 0 {
+		log.Printf("thermostat %s: hysteresis can not be negative", cfg.Name)
+		return
+	}
+
+	heater, err := newThermoChannel("heater", cfg)
+	if err != nil {
+		log.Printf("thermostat %s: %v", cfg.Name, err)
+		return
+	}
+	cooler, _ := newThermoChannel("cooler", cfg)
+
+	if len(cfg.Regulator) == 0 {
+		cfg.Regulator = "bangbang"
+	}
+	log.Printf("thermostat %s: using %s regulator, runtime %d seconds", cfg.Name, cfg.Regulator, cfg.Runtime)
+	if heater.proportioner != nil {
+		log.Printf("thermostat %s: time proportional output over %.0f seconds", cfg.Name, heater.proportioner.cycle.Seconds())
+	}
+
+	// Used to apply a partial failsafe duty when the regulator is on/off
+	failsafeProportioner := &timeProportioner{cycle: time.Minute * 10}
+
+	failsafe := false
+	usingFallback := false
+	prevMode := cfg.Mode
+
+	if sleep(time.Second * 10) {
+		return
+	}
+	runtime := (time.Second * time.Duration(cfg.Runtime))
+
+	// On stop the actuators are left as they are, unless released
+	defer func() {
+		z.mu.Lock()
+		release := z.releaseOnStop
+		z.mu.Unlock()
+		if !release {
+			return
+		}
+		// Switching off is always safe, so min_on does not hold it
+		for _, c := range []*thermoChannel{heater, cooler} {
+			if !c.on {
+				continue
+			}
+			if err := setOutputState(c.actuator, 0, true); err != nil {
+				log.Printf("thermostat %s: releasing %s: %v", cfg.Name, c.actuator, err)
+				continue
+			}
+			c.on = false
+		}
+	}()
+
+	var lastRegulation time.Time
 
 	for {
-		currentTemp, err := ReadTemp_DS18B20(feedbackSensorID)
-		if err != nil {
-			log.Panicf("thermostat: error reading temp from %s", feedbackSensorID)
-			continue
+		now := time.Now().UTC()
+
+		z.followSchedule(time.Now())
+		cfg = z.Config()
+
+		heater.actuator = cfg.Actuator
+		cooler.actuator = cfg.CoolingActuator
+		if len(cooler.actuator) == 0 {
+			cooler.actuator = cfg.Actuator
 		}
 
-		tempErr := (config.Thermostat.Setpoint - currentTemp)
+		// Channels not needed by the mode stop regulating, off and mode
+		// changes switch them off, manual leaves them as they are
+		wantHeat := cfg.Mode == ModeHeat || cfg.Mode == ModeHeatCool
+		wantCool := cfg.Mode == ModeCool || cfg.Mode == ModeHeatCool
+		for _, c := range []struct {
+			ch   *thermoChannel
+			want bool
+		}{{heater, wantHeat}, {cooler, wantCool}} {
+			if c.ch.active && !c.want {
+				c.ch.active = false
+				c.ch.regulator.Reset()
+				c.ch.demand = 0
+				log.Printf("thermostat %s: %s regulation stopped", cfg.Name, c.ch.kind)
+				c.ch.releasing = cfg.Mode != ModeManual && c.ch.on
+			} else if !c.ch.active && c.want {
+				// The actuator could have been switched by hand meanwhile
+				c.ch.active = true
+				c.ch.releasing = false
+				state, _ := GetOutputState(c.ch.actuator)
+				c.ch.on = state != 0
+				c.ch.lastUpdate = now
+				lastRegulation = time.Time{}
+				log.Printf("thermostat %s: %s regulation started", cfg.Name, c.ch.kind)
+			}
+		}
 
-		if tempErr > config.Thermostat.Hysteresis && !heaterState {
-			log.Printf("thermostat: Since the temp err is %.1f, turn on the actuator", tempErr)
-			heaterState = true
-			err := SetOutputState(config.Thermostat.Actuator, 1)
-			if err != nil {
-				log.Println(err)
+		if cfg.Mode == ModeOff && prevMode != ModeOff {
+			log.Printf("thermostat %s: switched off, actuators released", cfg.Name)
+			heater.releasing = true
+			cooler.releasing = cooler.actuator != heater.actuator
+		} else if cfg.Mode == ModeManual && prevMode != ModeManual {
+			log.Printf("thermostat %s: manual mode, actuators released", cfg.Name)
+			heater.releasing, cooler.releasing = false, false
+		}
+		for _, c := range []*thermoChannel{heater, cooler} {
+			shared := (heater.active || cooler.active) && heater.actuator == cooler.actuator
+			if c.releasing && !c.active && !shared && c.write(false) == nil {
+				c.releasing = false
+				c.on = false
 			}
-		} else if tempErr < (-1*config.Thermostat.Hysteresis) && heaterState {
-			log.Printf("thermostat: since the temp err is %.1f, turn off the actuator", tempErr)
-			heaterState = false
-			err := SetOutputState(config.Thermostat.Actuator, 0)
-			if err != nil {
-				log.Println(err)
+		}
+		if cfg.Mode != prevMode {
+			lastRegulation = time.Time{}
+		}
+		prevMode = cfg.Mode
+
+		if !heater.active && !cooler.active {
+			z.mu.Lock()
+			z.status.Demand = 0
+			z.status.CoolDemand = 0
+			z.status.HeaterOn = false
+			z.status.CoolerOn = false
+			z.mu.Unlock()
+			if sleep(time.Second) {
+				return
 			}
+			continue
 		}
 
-		// log.Printf("setpoint %.1f, feedback %.1f, actuator %t", config.Thermostat.Setpoint, currentTemp, heaterState)
+		if now.Sub(lastRegulation) >= runtime {
+			dt := runtime
+			if !lastRegulation.IsZero() {
+				dt = now.Sub(lastRegulation)
+			}
+			lastRegulation = now
+
+			currentTemp, source, err := readFeedback(cfg)
 
-		if time.Now().UTC().Sub(lastOutputUpdate) > time.Minute*10 {
-			lastOutputUpdate = time.Now().UTC()
-			outputState := int(0)
-			if heaterState {
-				outputState = 1
+			if err == nil && source != cfg.FeedbackName && !usingFallback {
+				usingFallback = true
+				RaiseAlarm(Alarm{Source: "thermostat", Name: cfg.Name, Kind: "feedback_fallback", Active: true,
+					Message: fmt.Sprintf("thermostat %s: sensor %s failed, using %s", cfg.Name, cfg.FeedbackName, source)})
+			} else if source == cfg.FeedbackName && usingFallback {
+				usingFallback = false
+				RaiseAlarm(Alarm{Source: "thermostat", Name: cfg.Name, Kind: "feedback_fallback", Active: false,
+					Message: fmt.Sprintf("thermostat %s: sensor %s is back", cfg.Name, cfg.FeedbackName)})
 			}
-			err := SetOutputState(config.Thermostat.Actuator, outputState)
+
 			if err != nil {
-				log.Println(err)
+				// Only heating has a failsafe duty, cooling just stops
+				heater.demand = 0
+				if heater.active {
+					heater.demand = math.Max(0, math.Min(1, cfg.Failsafe.Duty))
+				}
+				cooler.demand = 0
+				if !failsafe {
+					failsafe = true
+					heater.regulator.Reset()
+					cooler.regulator.Reset()
+					RaiseAlarm(Alarm{Source: "thermostat", Name: cfg.Name, Kind: "feedback_failure", Active: true,
+						Message: fmt.Sprintf("thermostat %s: unable to read temperature, failsafe at %.0f%%", cfg.Name, heater.demand*100)})
+				}
+			} else {
+				if failsafe {
+					failsafe = false
+					RaiseAlarm(Alarm{Source: "thermostat", Name: cfg.Name, Kind: "feedback_failure", Active: false,
+						Message: fmt.Sprintf("thermostat %s: temperature readings recovered", cfg.Name)})
+				}
+
+				// In heat_cool the deadband is split around the setpoint
+				halfDeadband := 0.0
+				if cfg.Mode == ModeHeatCool {
+					halfDeadband = cfg.Deadband / 2
+				}
+				if heater.active {
+					heater.demand = heater.regulator.Update(cfg, cfg.Setpoint-halfDeadband, currentTemp, dt)
+				}
+				// Cooling is heating with the error inverted
+				if cooler.active {
+					cooler.demand = cooler.regulator.Update(cfg, -(cfg.Setpoint + halfDeadband), -currentTemp, dt)
+				}
+				if heater.active && cooler.active {
+					if currentTemp > cfg.Setpoint {
+						heater.demand = 0
+					} else if currentTemp < cfg.Setpoint {
+						cooler.demand = 0
+					}
+				}
+			}
+
+			z.mu.Lock()
+			if err == nil {
+				z.status.MeasuredTemp = currentTemp
+				z.status.TempErr = cfg.Setpoint - currentTemp
+				z.status.SampledAt = now
+			}
+			z.status.Demand = heater.demand
+			z.status.CoolDemand = cooler.demand
+			z.status.Sensor = source
+			z.status.Failsafe = failsafe
+			z.mu.Unlock()
+
+			debugf("thermostat %s: setpoint %.1f, feedback %.1f, demand %.2f/%.2f", cfg.Name, cfg.Setpoint, currentTemp, heater.demand, cooler.demand)
+		}
+
+		tempErr := z.Status().TempErr
+		switched := false
+		for _, c := range []*thermoChannel{heater, cooler} {
+			if !c.active {
+				continue
+			}
+			// Switched off outside the zone, es. forced off by max_on
+			if state, ok := GetOutputState(c.actuator); ok && state == 0 && c.on {
+				log.Printf("thermostat %s: %s switched off outside the thermostat", cfg.Name, c.kind)
+				c.on = false
+				switched = true
+			}
+			var wanted bool
+			if c.proportioner != nil && !failsafe {
+				wanted = c.proportioner.On(c.demand, now)
+			} else if failsafe && c.demand > 0 && c.demand < 1 {
+				wanted = failsafeProportioner.On(c.demand, now)
+			} else {
+				wanted = c.demand >= 0.5
+			}
+			if c.set(cfg.Name, wanted, tempErr, now) {
+				switched = true
 			}
 		}
 
-		time.Sleep(runtime)
+		if switched {
+			z.mu.Lock()
+			z.status.HeaterOn = heater.active && heater.on
+			z.status.CoolerOn = cooler.active && cooler.on
+			z.status.LastSwitch = now
+			z.mu.Unlock()
+
+			PublishThermostatTelemetry()
+		}
+
+		if sleep(time.Second) {
+			return
+		}
+	}
+}
+
+// parseSetpointPayload parses "<setpoint> [duration]", es. "21.5 2h"
+func parseSetpointPayload(payload string) (float64, time.Duration, error) {
+	fields := strings.Fields(strings.ReplaceAll(payload, ",", "."))
+	if len(fields) == 0 || len(fields) > 2 {
+		return 0, 0, fmt.Errorf("invalid setpoint '%s'", payload)
+	}
+
+	setpoint, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid setpoint '%s'", payload)
+	}
+
+	duration, err := parseOverrideDuration(fields[1:])
+	return setpoint, duration, err
+}
+
+func parseOverrideDuration(fields []string) (time.Duration, error) {
+	if len(fields) == 0 {
+		return 0, nil
+	}
+	duration, err := time.ParseDuration(fields[0])
+	if err != nil || duration <= 0 {
+		return 0, fmt.Errorf("invalid duration '%s'", fields[0])
+	}
+	return duration, nil
+}
+
+// readFeedback reads the feedback sensor, retrying, and then the fallback
+// one. It returns the name of the sensor that answered.
+func readFeedback(cfg Thermostat) (float64, string, error) {
+	retries := cfg.Failsafe.Retries
+	if retries < 1 {
+		retries = 3
+	}
+
+	temp, err := readSensorRetry(cfg.FeedbackName, retries)
+	if err == nil {
+		return temp, cfg.FeedbackName, nil
+	}
+	log.Printf("thermostat %s: error reading temp from %s: %v", cfg.Name, cfg.FeedbackName, err)
+
+	if len(cfg.Failsafe.FallbackSensor) == 0 {
+		return 0, "", err
+	}
+	temp, err = readSensorRetry(cfg.Failsafe.FallbackSensor, retries)
+	if err != nil {
+		log.Printf("thermostat %s: error reading temp from %s: %v", cfg.Name, cfg.Failsafe.FallbackSensor, err)
+		return 0, "", err
+	}
+	return temp, cfg.Failsafe.FallbackSensor, nil
+}
+
+// readSensorRetry looks the sensor up in the running config at every
+// read, so reloads that change the sensor reach running zones
+func readSensorRetry(name string, retries int) (float64, error) {
+	s, found := FindSensor(name)
+	if !found {
+		return 0, fmt.Errorf("unknown sensor '%s'", name)
+	}
+
+	var err error
+	for i := 0; i < retries; i++ {
+		if i > 0 {
+			time.Sleep(time.Second * 2)
+		}
+		var temp float64
+		temp, err = ReadSensor(s)
+		if err == nil {
+			return temp, nil
+		}
+	}
+	return 0, err
+}
+
+func (z *ThermostatZone) telemetry() map[string]interface{} {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	heater := "OFF"
+	if z.status.HeaterOn {
+		heater = "ON"
+	}
+	cooler := "OFF"
+	if z.status.CoolerOn {
+		cooler = "ON"
+	}
+	t := map[string]interface{}{
+		"Enabled":   z.cfg.Enabled,
+		"Mode":      z.cfg.Mode,
+		"Setpoint":  z.cfg.Setpoint,
+		"Regulator": z.cfg.Regulator,
+		"Heater":    heater,
+		"Cooler":    cooler,
+	}
+	if !z.status.SampledAt.IsZero() {
+		t["Temperature"] = float64(int(z.status.MeasuredTemp*100)) / 100.0
+		t["Error"] = float64(int(z.status.TempErr*100)) / 100.0
+		t["Demand"] = float64(int(z.status.Demand*100)) / 100.0
+		t["CoolDemand"] = float64(int(z.status.CoolDemand*100)) / 100.0
+	}
+	if !z.status.LastSwitch.IsZero() {
+		t["LastSwitch"] = z.status.LastSwitch.UTC().Format(MQTT_DATETIME_FORMAT)
+	}
+	if len(z.status.Sensor) > 0 {
+		t["Sensor"] = z.status.Sensor
+	}
+	t["Failsafe"] = z.status.Failsafe
+	if !z.overrideUntil.IsZero() {
+		t["OverrideUntil"] = z.overrideUntil.UTC().Format(MQTT_DATETIME_FORMAT)
+	}
+	return t
+}
+
+// PublishThermostatTelemetry sends the state of every zone on
+// tele/<topic>/THERMOSTAT, keyed by zone name
+func PublishThermostatTelemetry() {
+	client := getMQTTClient()
+	zones := getZones()
+	if client == nil || len(zones) == 0 {
+		return
+	}
+
+	jsonObj := map[string]interface{}{}
+	jsonObj["Time"] = time.Now().UTC().Format(MQTT_DATETIME_FORMAT)
+	for _, z := range zones {
+		jsonObj[z.Name()] = z.telemetry()
+	}
+
+	jsonStr, err := json.Marshal(jsonObj)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	client.Publish(fmt.Sprintf("tele/%s/THERMOSTAT", getConfig().MQTT.Topic), 0, false, jsonStr)
+}
+
+// publishSetpoint keeps the retained stat/<topic>/<zone>/TEMPTARGET up to date
+func (z *ThermostatZone) publishSetpoint() {
+	client := getMQTTClient()
+	if client == nil {
+		return
+	}
+	client.Publish(
+		fmt.Sprintf("stat/%s/%s/TEMPTARGET", getConfig().MQTT.Topic, z.Name()),
+		0, true,
+		strconv.FormatFloat(z.Config().Setpoint, 'f', -1, 64),
+	)
+}
+
+// publishMode keeps the retained stat/<topic>/<zone>/MODE and
+// stat/<topic>/<zone>/THERMOSTAT (ON while regulating) up to date
+func (z *ThermostatZone) publishMode() {
+	client := getMQTTClient()
+	config := getConfig()
+	if client == nil {
+		return
+	}
+	cfg := z.Config()
+	enabled := "OFF"
+	if cfg.Enabled {
+		enabled = "ON"
+	}
+	client.Publish(fmt.Sprintf("stat/%s/%s/MODE", config.MQTT.Topic, cfg.Name), 0, true, cfg.Mode)
+	client.Publish(fmt.Sprintf("stat/%s/%s/THERMOSTAT", config.MQTT.Topic, cfg.Name), 0, true, enabled)
+}
+
+// clearRetained removes the retained stat topics of a zone no longer
+// in the config
+func (z *ThermostatZone) clearRetained() {
+	client := getMQTTClient()
+	if client == nil {
+		return
+	}
+	for _, command := range []string{"TEMPTARGET", "MODE", "THERMOSTAT"} {
+		client.Publish(fmt.Sprintf("stat/%s/%s/%s", getConfig().MQTT.Topic, z.Name(), command), 0, true, "")
+	}
+}
+
+func ThermostatTelemetryRoutine(interval int) {
+	for {
+		PublishThermostatTelemetry()
+		time.Sleep(time.Second * time.Duration(interval))
 	}
 }
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestThermostatModes(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Thermostat
+		want []string
+	}{
+		{"heating only", Thermostat{Actuator: "boiler"}, []string{ModeHeat, ModeOff}},
+		{"single actuator cooling", Thermostat{Actuator: "heatpump", SingleActuatorCooling: true}, []string{ModeHeat, ModeCool, ModeOff}},
+		{"cooling actuator", Thermostat{Actuator: "boiler", CoolingActuator: "chiller"}, []string{ModeHeat, ModeCool, ModeHeatCool, ModeOff}},
+	}
+	for _, tt := range tests {
+		got := tt.cfg.Modes()
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: modes %v, want %v", tt.name, got, tt.want)
+		}
+		for _, mode := range append(got, ModeManual) {
+			if err := tt.cfg.checkMode(mode); err != nil {
+				t.Errorf("%s: %s refused: %v", tt.name, mode, err)
+			}
+		}
+		for _, mode := range []string{ModeHeat, ModeCool, ModeHeatCool} {
+			if !containsString(got, mode) && tt.cfg.checkMode(mode) == nil {
+				t.Errorf("%s: %s accepted", tt.name, mode)
+			}
+		}
+	}
+}
+
+func TestSetModeUnsupported(t *testing.T) {
+	z := NewThermostatZone(Thermostat{Name: "living", Actuator: "boiler", Mode: ModeHeat})
+	if err := z.SetMode(ModeCool); err == nil {
+		t.Error("cool accepted without a cooling actuator")
+	}
+	if mode := z.Config().Mode; mode != ModeHeat {
+		t.Errorf("mode %s after a refused change, want heat", mode)
+	}
+}
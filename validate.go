@@ -0,0 +1,585 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// phone numbers as the HiLink modem reports them, es. +393331234567
+var phoneNumberRegex = regexp.MustCompile(`^\+?[0-9]{6,15}$`)
+
+var scheduleWeekKeys = append([]string{"weekdays", "weekend", "daily"}, scheduleDayKeys...)
+
+// ValidateConfigFile loads a config file and validates it, the errors
+// are all the problems found, not just the first one
+func ValidateConfigFile(path string) (FortinoConfig, []error) {
+	c, errs := loadConfig(path)
+	if len(errs) > 0 {
+		return c, errs
+	}
+
+	errs = unknownFileFields(path)
+	if secrets := secretsFilePath(&c, path); len(secrets) > 0 {
+		errs = append(errs, unknownFileFields(secrets)...)
+	}
+
+	return c, append(errs, ValidateConfig(&c)...)
+}
+
+// unknownFileFields reports the fields of a json file unknown to
+// FortinoConfig, prefixed by the file name
+func unknownFileFields(path string) []error {
+	var raw interface{}
+	byteValue, err := ioutil.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(byteValue, &raw)
+	}
+	if err != nil {
+		return []error{fmt.Errorf("%s: %v", path, err)}
+	}
+
+	errs := unknownFields("", raw, reflect.TypeOf(FortinoConfig{}))
+	for i, err := range errs {
+		errs[i] = fmt.Errorf("%s: %v", filepath.Base(path), err)
+	}
+	return errs
+}
+
+// unknownFields reports the keys of raw that don't match any field of t,
+// matching names like encoding/json does
+func unknownFields(path string, raw interface{}, t reflect.Type) []error {
+	var errs []error
+
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		obj, ok := raw.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		for _, key := range sortedKeys(obj) {
+			value := obj[key]
+			field, found := jsonField(t, key)
+			if !found {
+				errs = append(errs, fmt.Errorf("%s: unknown field", joinPath(path, key)))
+				continue
+			}
+			errs = append(errs, unknownFields(joinPath(path, key), value, field.Type)...)
+		}
+	case reflect.Slice, reflect.Array:
+		list, ok := raw.([]interface{})
+		if !ok {
+			return nil
+		}
+		for i, value := range list {
+			errs = append(errs, unknownFields(fmt.Sprintf("%s[%d]", path, i), value, t.Elem())...)
+		}
+	case reflect.Map:
+		obj, ok := raw.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		for _, key := range sortedKeys(obj) {
+			errs = append(errs, unknownFields(joinPath(path, key), obj[key], t.Elem())...)
+		}
+	}
+	return errs
+}
+
+func jsonField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if len(f.PkgPath) > 0 {
+			continue
+		}
+		name := f.Name
+		if tag := strings.Split(f.Tag.Get("json"), ",")[0]; tag == "-" {
+			continue
+		} else if len(tag) > 0 {
+			name = tag
+		}
+		if strings.EqualFold(name, key) {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+func joinPath(path string, key string) string {
+	if len(path) == 0 {
+		return key
+	}
+	return path + "." + key
+}
+
+// commandWords are the cmnd topics handled before the outputs, an output
+// with one of these names could never be switched
+var commandWords = []string{"MODE", "PRESET", "THERMOSTAT", "TEMPTARGETSET", "RULE"}
+
+func isCommandWord(name string) bool {
+	for _, w := range commandWords {
+		if strings.EqualFold(name, w) {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateConfig checks references between sections and values that
+// would otherwise only fail while running
+func ValidateConfig(c *FortinoConfig) []error {
+	var errs []error
+	fail := func(format string, a ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, a...))
+	}
+
+	// MQTT
+	if len(c.MQTT.Topic) == 0 {
+		fail("mqtt.topic: missing")
+	} else if strings.ContainsAny(c.MQTT.Topic, "+#/ ") {
+		fail("mqtt.topic: '%s' can not contain '+', '#', '/' or spaces", c.MQTT.Topic)
+	}
+	if len(c.MQTT.Host) == 0 {
+		fail("mqtt.host: missing")
+	}
+	if c.MQTT.Port <= 0 || c.MQTT.Port > 65535 {
+		fail("mqtt.port: %d out of range 1..65535", c.MQTT.Port)
+	}
+	if c.MQTT.KeepAlive < 0 {
+		fail("mqtt.keepalive: can not be negative")
+	}
+	if len(c.MQTT.Password) > 0 && len(c.MQTT.Username) == 0 {
+		fail("mqtt.password: set without a username")
+	}
+
+	if _, err := NewGPIODriver(c.GPIO); err != nil {
+		fail("gpio_driver: %v", err)
+	}
+
+	// Outputs, names and pins must be unique
+	outputs := map[string]bool{}
+	pins := map[byte]string{}
+	for i, o := range c.DigitalOutputs {
+		path := fmt.Sprintf("outputs[%d]", i)
+		if len(o.Name) == 0 {
+			fail("%s: missing name", path)
+		} else if strings.ContainsAny(o.Name, "+#/ ") {
+			fail("%s: name '%s' can not contain '+', '#', '/' or spaces", path, o.Name)
+		} else if isCommandWord(o.Name) {
+			fail("%s: name '%s' is an MQTT command", path, o.Name)
+		} else if outputs[o.Name] {
+			fail("%s: duplicate name %s", path, o.Name)
+		}
+		outputs[o.Name] = true
+		if other, used := pins[o.PIN]; used {
+			fail("%s: pin %d already used by %s", path, o.PIN, other)
+		}
+		pins[o.PIN] = o.Name
+		if o.Protection.MinOn > 0 && o.Protection.MaxOn > 0 && o.Protection.MaxOn < o.Protection.MinOn {
+			fail("%s: protection max_on shorter than min_on", path)
+		}
+	}
+
+	// Groups, members are only switched through their group
+	members := map[string]string{}
+	groups := map[string]bool{}
+	for i, g := range c.OutputGroups {
+		path := fmt.Sprintf("output_groups[%d]", i)
+		if len(g.Name) == 0 {
+			fail("%s: missing name", path)
+		} else if strings.ContainsAny(g.Name, "+#/ ") {
+			fail("%s: name '%s' can not contain '+', '#', '/' or spaces", path, g.Name)
+		} else if isCommandWord(g.Name) {
+			fail("%s: name '%s' is an MQTT command", path, g.Name)
+		} else if outputs[g.Name] || groups[g.Name] {
+			fail("%s: duplicate name %s", path, g.Name)
+		}
+		groups[g.Name] = true
+		if len(g.Members) == 0 {
+			fail("%s: no members", path)
+		}
+		for _, m := range g.Members {
+			if !outputs[m] {
+				fail("%s: unknown member '%s'", path, m)
+			} else if other, used := members[m]; used {
+				fail("%s: member %s already in group %s", path, m, other)
+			}
+			members[m] = g.Name
+		}
+		if g.Protection.MinOn > 0 && g.Protection.MaxOn > 0 && g.Protection.MaxOn < g.Protection.MinOn {
+			fail("%s: protection max_on shorter than min_on", path)
+		}
+	}
+	addressable := map[string]bool{}
+	for _, name := range outputNames(c) {
+		addressable[name] = true
+	}
+	for i, g := range c.OutputGroups {
+		for _, other := range g.Interlock {
+			if other == g.Name {
+				fail("output_groups[%d]: interlock with itself", i)
+			} else if !addressable[other] {
+				fail("output_groups[%d]: unknown interlock output '%s'", i, other)
+			}
+		}
+	}
+
+	// Inputs, pins can't be shared with the outputs
+	inputs := map[string]bool{}
+	inputKeys := map[string]string{}
+	for i, in := range c.DigitalInputs {
+		path := fmt.Sprintf("inputs[%d]", i)
+		if len(in.Name) == 0 {
+			fail("%s: missing name", path)
+		} else if inputs[in.Name] {
+			fail("%s: duplicate name %s", path, in.Name)
+		}
+		inputs[in.Name] = true
+		key := inputTopicKey(c, in.Name)
+		if other, used := inputKeys[strings.ToLower(key)]; used && other != in.Name {
+			fail("%s: id %s already used by %s", path, key, other)
+		} else if addressable[key] || strings.ContainsAny(key, "+#/ ") {
+			fail("%s: invalid id '%s'", path, key)
+		}
+		inputKeys[strings.ToLower(key)] = in.Name
+		if other, used := pins[in.PIN]; used {
+			fail("%s: pin %d already used by %s", path, in.PIN, other)
+		}
+		pins[in.PIN] = in.Name
+		if !containsString(inputPulls, in.Pull) {
+			fail("%s: unknown pull '%s', expected up, down or none", path, in.Pull)
+		}
+		if !containsString(inputEdges, in.Edge) {
+			fail("%s: unknown edge '%s', expected both, rising or falling", path, in.Edge)
+		}
+		if !containsString(inputActions, in.Action) {
+			fail("%s: unknown action '%s', expected toggle or follow", path, in.Action)
+		} else if len(in.Action) > 0 && len(in.Output) == 0 {
+			fail("%s: action %s without an output", path, in.Action)
+		} else if in.Action == "follow" && in.Edge != "" && in.Edge != "both" {
+			fail("%s: action follow needs edge both, with %s the output misses the other edge", path, in.Edge)
+		}
+		if len(in.Output) > 0 && !addressable[in.Output] {
+			fail("%s: unknown output '%s'", path, in.Output)
+		}
+	}
+
+	// Sensors
+	sensors := map[string]bool{}
+	for i, s := range c.Onewires {
+		path := fmt.Sprintf("onewire[%d]", i)
+		if len(s.Name) == 0 {
+			fail("%s: missing name", path)
+		} else if sensors[s.Name] {
+			fail("%s: duplicate name %s", path, s.Name)
+		}
+		sensors[s.Name] = true
+		if len(s.ID) == 0 {
+			fail("%s: missing id", path)
+		}
+		if _, ok := SensorDriverFor(s.Type); !ok {
+			fail("%s: unknown type '%s'", path, s.Type)
+		}
+		a := s.Alarms
+		if a.High != nil && a.Low != nil && *a.Low >= *a.High {
+			fail("%s: alarms low %g must be lower than high %g", path, *a.Low, *a.High)
+		}
+		if a.Rate < 0 || a.Hysteresis < 0 {
+			fail("%s: alarms rate and hysteresis can not be negative", path)
+		}
+		if interval := c.UpdateInterval; a.Offline > 0 && int(a.Offline) <= interval {
+			fail("%s: alarms offline %ds must be longer than update_interval %ds", path, a.Offline, interval)
+		}
+	}
+
+	// Thermostats
+	if len(c.Thermostat.Actuator) > 0 && len(c.Thermostats) > 0 {
+		fail("thermostat: use either thermostat or thermostats")
+	}
+	zones := map[string]bool{}
+	actuators := map[string]string{}
+	for _, t := range ThermostatConfigs(c) {
+		path := fmt.Sprintf("thermostat %s", t.Name)
+		t = normalizeThermostat(t)
+
+		if strings.ContainsAny(t.Name, "+#/ ") {
+			fail("%s: name can not contain '+', '#', '/' or spaces", path)
+		} else if zones[strings.ToLower(t.Name)] {
+			fail("%s: duplicate name", path)
+		}
+		zones[strings.ToLower(t.Name)] = true
+
+		if err := t.checkMode(t.Mode); err != nil {
+			fail("%s: %v", path, err)
+		}
+		if _, err := NewRegulator(t.Regulator); err != nil {
+			fail("%s: %v", path, err)
+		}
+		if t.Hysteresis < 0 {
+			fail("%s: hysteresis can not be negative", path)
+		}
+		if t.Deadband < 0 {
+			fail("%s: deadband can not be negative", path)
+		}
+
+		if !sensors[t.FeedbackName] {
+			fail("%s: unknown feedback sensor '%s'", path, t.FeedbackName)
+		}
+		if len(t.Failsafe.FallbackSensor) > 0 && !sensors[t.Failsafe.FallbackSensor] {
+			fail("%s: unknown fallback sensor '%s'", path, t.Failsafe.FallbackSensor)
+		}
+		if t.Failsafe.Duty < 0 || t.Failsafe.Duty > 1 {
+			fail("%s: failsafe duty %g out of range 0..1", path, t.Failsafe.Duty)
+		}
+
+		for _, a := range []string{t.Actuator, t.CoolingActuator} {
+			if len(a) == 0 {
+				continue
+			}
+			if group, grouped := members[a]; grouped {
+				fail("%s: actuator %s is a member of group %s, use the group", path, a, group)
+			} else if !addressable[a] {
+				fail("%s: unknown actuator '%s'", path, a)
+			} else if other, used := actuators[a]; used && other != t.Name {
+				fail("%s: actuator %s already driven by thermostat %s", path, a, other)
+			}
+			actuators[a] = t.Name
+		}
+		if len(t.Actuator) == 0 {
+			fail("%s: missing actuator", path)
+		}
+		if t.SingleActuatorCooling && len(t.CoolingActuator) > 0 {
+			fail("%s: single_actuator_cooling is for zones without a cooling_actuator", path)
+		}
+		if len(t.CoolingActuator) > 0 && t.CoolingActuator == t.Actuator {
+			fail("%s: cooling_actuator can not be the heating actuator", path)
+		}
+
+		min, max, _ := t.SetpointRange()
+		if min >= max {
+			fail("%s: min_setpoint %g must be lower than max_setpoint %g", path, min, max)
+		} else if _, err := t.checkSetpoint(t.Setpoint); err != nil {
+			fail("%s: %v", path, err)
+		}
+
+		presets := []string{}
+		for preset := range t.Schedule.Presets {
+			presets = append(presets, preset)
+		}
+		sort.Strings(presets)
+		for _, preset := range presets {
+			if _, err := t.checkSetpoint(t.Schedule.Presets[preset]); err != nil {
+				fail("%s: preset %s: %v", path, preset, err)
+			}
+		}
+		days := []string{}
+		for day := range t.Schedule.Week {
+			days = append(days, day)
+		}
+		sort.Strings(days)
+		for _, day := range days {
+			slots := t.Schedule.Week[day]
+			if !containsString(scheduleWeekKeys, day) {
+				fail("%s: schedule: unknown day '%s'", path, day)
+			}
+			for _, slot := range slots {
+				if _, _, err := parseSlotTime(slot.At); err != nil {
+					fail("%s: %v", path, err)
+				}
+				if setpoint, err := t.Schedule.SlotSetpoint(slot); err != nil {
+					fail("%s: %v", path, err)
+				} else if _, err := t.checkSetpoint(setpoint); err != nil {
+					fail("%s: schedule %s %s: %v", path, day, slot.At, err)
+				}
+			}
+		}
+	}
+
+	// Rules
+	rules := map[string]bool{}
+	for i, r := range c.Rules {
+		path := fmt.Sprintf("rules[%d]", i)
+		if len(r.Name) == 0 {
+			fail("%s: missing name", path)
+		} else if rules[r.Name] {
+			fail("%s: duplicate name %s", path, r.Name)
+		} else if strings.ContainsAny(r.Name, " ") {
+			fail("%s: name '%s' can not contain spaces", path, r.Name)
+		}
+		rules[r.Name] = true
+		for _, err := range validateRule(c, r, sensors, inputs, addressable) {
+			fail("%s: %v", path, err)
+		}
+	}
+
+	// SMS gateway
+	if c.HiLinkConfig.Enable && len(c.HiLinkConfig.Address) == 0 {
+		fail("hilink_config.address: missing")
+	}
+	for i, p := range c.HiLinkConfig.AllowedPhones {
+		if !phoneNumberRegex.MatchString(p) {
+			fail("hilink_config.allowed_phones[%d]: invalid phone number '%s'", i, p)
+		}
+	}
+
+	// HTTP API
+	if c.HTTP.Enabled && len(c.HTTP.Listen) > 0 {
+		if _, _, err := net.SplitHostPort(c.HTTP.Listen); err != nil {
+			fail("http.listen: %v", err)
+		}
+	}
+	if len(c.HTTP.Password) > 0 && len(c.HTTP.Username) == 0 {
+		fail("http.password: set without a username")
+	}
+
+	if strings.ContainsAny(c.HomeAssistant.DiscoveryPrefix, "+#") {
+		fail("homeassistant.discovery_prefix: can not contain '+' or '#'")
+	}
+
+	return errs
+}
+
+func sortedKeys(obj map[string]interface{}) []string {
+	keys := []string{}
+	for key := range obj {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// validateRule checks the trigger and actions of a rule against the
+// sensors, inputs and outputs
+func validateRule(c *FortinoConfig, r RuleConfig, sensors map[string]bool, inputs map[string]bool, outputs map[string]bool) []error {
+	var errs []error
+	fail := func(format string, a ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, a...))
+	}
+
+	t := r.Trigger
+	switch t.Type {
+	case "sensor":
+		if !sensors[t.Sensor] && t.Sensor != "RPI" {
+			fail("trigger: unknown sensor '%s'", t.Sensor)
+		}
+		if (t.Above == nil) == (t.Below == nil) {
+			fail("trigger: expected either above or below")
+		}
+		if t.Hysteresis < 0 {
+			fail("trigger: hysteresis can not be negative")
+		}
+	case "input":
+		if !inputs[t.Input] {
+			fail("trigger: unknown input '%s'", t.Input)
+		}
+		if !containsString(inputEdges, t.Edge) {
+			fail("trigger: unknown edge '%s', expected both, rising or falling", t.Edge)
+		}
+		// Rules only see the edges the input reports
+		for _, in := range c.DigitalInputs {
+			if in.Name == t.Input && in.Edge != "" && in.Edge != "both" && t.Edge != "" && t.Edge != "both" && t.Edge != in.Edge {
+				fail("trigger: edge %s never fires, input %s only reports %s", t.Edge, in.Name, in.Edge)
+			}
+		}
+	case "time":
+		if _, _, err := parseSlotTime(t.At); err != nil {
+			fail("trigger: %v", err)
+		}
+		for _, day := range t.Days {
+			if !containsString(scheduleWeekKeys, day) {
+				fail("trigger: unknown day '%s'", day)
+			}
+		}
+	case "mqtt":
+		if len(t.Topic) == 0 {
+			fail("trigger: missing topic")
+		} else if strings.HasPrefix(t.Topic, fmt.Sprintf("cmnd/%s/", c.MQTT.Topic)) {
+			// Those messages would no longer reach the command handler
+			fail("trigger: topic %s is a fortino command topic", t.Topic)
+		} else if !mqttTopicFilterValid(t.Topic) {
+			fail("trigger: invalid topic filter '%s'", t.Topic)
+		}
+	default:
+		fail("trigger: unknown type '%s', expected one of %s", t.Type, strings.Join(ruleTriggerTypes, ", "))
+	}
+
+	if len(r.Actions) == 0 {
+		fail("no actions")
+	}
+	for i, a := range r.Actions {
+		path := fmt.Sprintf("actions[%d]", i)
+		switch a.Type {
+		case "output":
+			if !outputs[a.Output] {
+				fail("%s: unknown output '%s'", path, a.Output)
+			}
+			if _, err := parsePowerPayload(a.State, 0); err != nil {
+				fail("%s: %v", path, err)
+			}
+		case "setpoint":
+			var zone *Thermostat
+			for _, z := range ThermostatConfigs(c) {
+				if len(a.Zone) == 0 || strings.EqualFold(z.Name, a.Zone) {
+					z := normalizeThermostat(z)
+					zone = &z
+					break
+				}
+			}
+			if zone == nil {
+				fail("%s: unknown thermostat zone '%s'", path, a.Zone)
+			} else if a.Setpoint == nil {
+				fail("%s: missing setpoint", path)
+			} else if _, err := zone.checkSetpoint(*a.Setpoint); err != nil {
+				fail("%s: %v", path, err)
+			}
+			if _, err := parseOverrideDuration(strings.Fields(a.Duration)); err != nil {
+				fail("%s: %v", path, err)
+			}
+		case "publish":
+			if len(a.Topic) == 0 || strings.ContainsAny(a.Topic, "+#") {
+				fail("%s: invalid topic '%s'", path, a.Topic)
+			}
+		case "sms":
+			if len(a.Message) == 0 {
+				fail("%s: missing message", path)
+			}
+		default:
+			fail("%s: unknown type '%s', expected one of %s", path, a.Type, strings.Join(ruleActionTypes, ", "))
+		}
+	}
+	return errs
+}
+
+// mqttTopicFilterValid checks the wildcards, + takes a whole level and #
+// only the last one
+func mqttTopicFilterValid(filter string) bool {
+	levels := strings.Split(filter, "/")
+	for i, l := range levels {
+		if strings.Contains(l, "#") && (l != "#" || i != len(levels)-1) {
+			return false
+		}
+		if strings.Contains(l, "+") && l != "+" {
+			return false
+		}
+	}
+	return true
+}
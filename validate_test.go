@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidateSampleConfig(t *testing.T) {
+	_, errs := ValidateConfigFile("sample_config.json")
+	for _, err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(c *FortinoConfig)
+		want   string
+	}{
+		{"topic with a level", func(c *FortinoConfig) { c.MQTT.Topic = "home/fortino" }, "mqtt.topic"},
+		{"no host", func(c *FortinoConfig) { c.MQTT.Host = "" }, "mqtt.host: missing"},
+		{"port", func(c *FortinoConfig) { c.MQTT.Port = 70000 }, "mqtt.port"},
+		{"duplicate output", func(c *FortinoConfig) { c.DigitalOutputs[1].Name = c.DigitalOutputs[0].Name }, "duplicate"},
+		{"output name with a level", func(c *FortinoConfig) { c.DigitalOutputs[0].Name = "POWER/1" }, "can not contain"},
+		{"output named as a command", func(c *FortinoConfig) { c.DigitalOutputs[0].Name = "Mode" }, "MQTT command"},
+		{"group name with a space", func(c *FortinoConfig) { c.OutputGroups[0].Name = "POWER 1" }, "can not contain"},
+		{"group named as a command", func(c *FortinoConfig) { c.OutputGroups[0].Name = "RULE" }, "MQTT command"},
+		{"zone name with a wildcard", func(c *FortinoConfig) { c.Thermostats[0].Name = "living#" }, "can not contain"},
+		{"follow on one edge", func(c *FortinoConfig) { c.DigitalInputs[0].Action = "follow" }, "action follow needs edge both"},
+		{"rule edge not reported by the input", func(c *FortinoConfig) { c.DigitalInputs[1].Edge = "falling" }, "edge rising never fires"},
+		{"unknown feedback", func(c *FortinoConfig) { c.Thermostats[0].FeedbackName = "nowhere" }, "unknown feedback sensor 'nowhere'"},
+		{"unknown actuator", func(c *FortinoConfig) { c.Thermostats[0].Actuator = "nothing" }, "unknown actuator 'nothing'"},
+		{"invalid mode", func(c *FortinoConfig) { c.Thermostats[0].Mode = "auto" }, "invalid thermostat mode 'auto'"},
+		{"cool without a cooling actuator", func(c *FortinoConfig) { c.Thermostats[0].Mode = ModeCool }, "cool needs"},
+		{"heat_cool with single actuator cooling", func(c *FortinoConfig) {
+			c.Thermostats[0].Mode = ModeHeatCool
+			c.Thermostats[0].SingleActuatorCooling = true
+		}, "heat_cool needs a cooling_actuator"},
+		{"negative hysteresis", func(c *FortinoConfig) { c.Thermostats[0].Hysteresis = -1 }, "hysteresis can not be negative"},
+	}
+
+	for _, tt := range tests {
+		c, err := LoadConfig("sample_config.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tt.change(&c)
+
+		errs := ValidateConfig(&c)
+		found := false
+		for _, err := range errs {
+			found = found || strings.Contains(err.Error(), tt.want)
+		}
+		if !found {
+			t.Errorf("%s: errors %v, want one with %q", tt.name, errs, tt.want)
+		}
+	}
+
+	c, err := LoadConfig("sample_config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Thermostats[0].Mode = ModeCool
+	c.Thermostats[0].SingleActuatorCooling = true
+	if errs := ValidateConfig(&c); len(errs) > 0 {
+		t.Errorf("cool with single_actuator_cooling: %v", errs)
+	}
+}
+
+func TestUnknownFields(t *testing.T) {
+	var raw interface{}
+	err := json.Unmarshal([]byte(`{
+		"mqtt": {"topic": "fortino", "hots": "broker"},
+		"OUTPUTS": [{"name": "POWER1", "pin": 5}, {"name": "POWER2", "pinn": 6}],
+		"thermostats": [{"name": "living", "schedule": {"week": {"daily": [{"at": "07:00", "temp": 20}]}}}],
+		"colour": "blue"
+	}`), &raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, err := range unknownFields("", raw, reflect.TypeOf(FortinoConfig{})) {
+		got = append(got, err.Error())
+	}
+	want := []string{
+		"OUTPUTS[1].pinn: unknown field",
+		"colour: unknown field",
+		"mqtt.hots: unknown field",
+		"thermostats[0].schedule.week.daily[0].temp: unknown field",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unknown fields\n got %q\nwant %q", got, want)
+	}
+}